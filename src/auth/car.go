@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+//
+// Cars authenticate their signaling requests with an HMAC-SHA256 signature over the raw request body, using a key
+// that is shared between the car and the server. Because the body contains the SDP offer (with the car's DTLS fingerprint)
+// and the timestamp, a captured signature cannot be reused to register a different car or to tamper with the timestamp offset.
+// Requests whose timestamp is too far off from the clock of the server are rejected, so that they cannot be replayed later.
+//
+// The signature is sent in the Authorization header: "Authorization: HMAC-SHA256 <hex encoded signature>"
+//
+
+const CarAuthScheme = "HMAC-SHA256"
+
+var (
+	ErrMissingCredentials = fmt.Errorf("Missing credentials")
+	ErrInvalidCredentials = fmt.Errorf("Invalid credentials")
+)
+
+// Computes the signature a car needs to send along with the given request body
+func SignCarRequest(key []byte, body []byte) string {
+	return hex.EncodeToString(carSignature(key, body))
+}
+
+func carSignature(key []byte, body []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// The part of a signed request body that is checked for freshness
+type carRequestTimestamp struct {
+	Timestamp int64 `json:"timestamp"` // unix milliseconds
+}
+
+// Verifies the Authorization header of a car request against its body. If maxSkew is not 0, the timestamp in the body
+// cannot be further off from now than maxSkew
+func VerifyCarRequest(key []byte, authorization string, body []byte, now time.Time, maxSkew time.Duration) error {
+	scheme, signature, found := strings.Cut(strings.TrimSpace(authorization), " ")
+	if authorization == "" || !found {
+		return ErrMissingCredentials
+	}
+	if !strings.EqualFold(scheme, CarAuthScheme) {
+		return fmt.Errorf("%w: unsupported authorization scheme '%s'", ErrMissingCredentials, scheme)
+	}
+
+	provided, err := hex.DecodeString(strings.TrimSpace(signature))
+	if err != nil {
+		return fmt.Errorf("%w: signature is not hex encoded", ErrInvalidCredentials)
+	}
+
+	if !hmac.Equal(provided, carSignature(key, body)) {
+		return ErrInvalidCredentials
+	}
+
+	if maxSkew == 0 {
+		return nil
+	}
+	request := carRequestTimestamp{}
+	if err := json.Unmarshal(body, &request); err != nil || request.Timestamp == 0 {
+		return fmt.Errorf("%w: request has no timestamp", ErrInvalidCredentials)
+	}
+	skew := now.Sub(time.UnixMilli(request.Timestamp))
+	if skew > maxSkew || skew < -maxSkew {
+		return fmt.Errorf("%w: request timestamp is %s off, it was replayed or the clock of the car is not synchronized", ErrInvalidCredentials, skew.Round(time.Millisecond))
+	}
+	return nil
+}
+
+// Cars that use WHIP authenticate with a Bearer token signed with the car key instead, the subject of the token is the car id
+type CarClaims struct {
+	Subject   string `json:"sub"`
+	Room      string `json:"room,omitempty"` // if set, the token is only valid for this room
+	ExpiresAt int64  `json:"exp,omitempty"`  // unix seconds
+	NotBefore int64  `json:"nbf,omitempty"`  // unix seconds
+}
+
+// Creates a signed token that a car can use for WHIP
+func SignCarToken(key []byte, claims CarClaims) (string, error) {
+	return signToken(key, claims)
+}
+
+// Verifies a car token from the Authorization header and returns its claims
+func VerifyCarToken(key []byte, authorization string, now time.Time) (*CarClaims, error) {
+	claims := CarClaims{}
+	if err := verifyToken(key, authorization, &claims); err != nil {
+		return nil, err
+	}
+	if err := checkValidity(claims.ExpiresAt, claims.NotBefore, now); err != nil {
+		return nil, err
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: token has no car id", ErrInvalidCredentials)
+	}
+
+	return &claims, nil
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	rtc "github.com/VU-ASE/roverrtc/src"
+)
+
+// Returns a signed SDP request of a car, sent at the given time
+func signedCarRequest(t *testing.T, key []byte, sentAt time.Time) ([]byte, string) {
+	t.Helper()
+
+	body, err := json.Marshal(rtc.RequestSDP{Id: "car", Timestamp: sentAt.UnixMilli()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body, CarAuthScheme + " " + SignCarRequest(key, body)
+}
+
+func TestVerifyCarRequest(t *testing.T) {
+	key := []byte("car key")
+	now := time.Now()
+	body, authorization := signedCarRequest(t, key, now)
+
+	if err := VerifyCarRequest(key, authorization, body, now.Add(time.Second), 30*time.Second); err != nil {
+		t.Errorf("Fresh request was rejected: %v", err)
+	}
+	if err := VerifyCarRequest([]byte("other key"), authorization, body, now, 30*time.Second); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Request signed with another key = %v, want %v", err, ErrInvalidCredentials)
+	}
+	if err := VerifyCarRequest(key, "", body, now, 30*time.Second); !errors.Is(err, ErrMissingCredentials) {
+		t.Errorf("Request without signature = %v, want %v", err, ErrMissingCredentials)
+	}
+}
+
+func TestVerifyCarRequestReplayed(t *testing.T) {
+	key := []byte("car key")
+	sentAt := time.Now()
+	body, authorization := signedCarRequest(t, key, sentAt)
+
+	// The captured request is sent again a minute later, its signature is still valid
+	if err := VerifyCarRequest(key, authorization, body, sentAt.Add(time.Minute), 30*time.Second); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Replayed request = %v, want %v", err, ErrInvalidCredentials)
+	}
+	// A car whose clock is ahead cannot sign requests that stay valid in the future either
+	if err := VerifyCarRequest(key, authorization, body, sentAt.Add(-time.Minute), 30*time.Second); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Request from the future = %v, want %v", err, ErrInvalidCredentials)
+	}
+	// The check can be disabled
+	if err := VerifyCarRequest(key, authorization, body, sentAt.Add(time.Minute), 0); err != nil {
+		t.Errorf("Old request was rejected with the check disabled: %v", err)
+	}
+}
+
+func TestVerifyCarRequestWithoutTimestamp(t *testing.T) {
+	key := []byte("car key")
+	body := []byte(`{"id":"car"}`)
+	authorization := CarAuthScheme + " " + SignCarRequest(key, body)
+
+	if err := VerifyCarRequest(key, authorization, body, time.Now(), 30*time.Second); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Request without timestamp = %v, want %v", err, ErrInvalidCredentials)
+	}
+}
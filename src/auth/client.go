@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"fmt"
+	"time"
+)
+
+//
+// Clients authenticate with a JSON Web Token (HS256) that is signed with a key known to the server.
+// The role claim of the token determines what the client is allowed to do once it is connected.
+//
+// The token is sent in the Authorization header: "Authorization: Bearer <token>"
+//
+
+type Role string
+
+const (
+	RoleViewer     Role = "viewer"     // can only receive frames
+	RoleController Role = "controller" // can take over human control and send control data
+	RoleAdmin      Role = "admin"      // can do everything a controller can, and force-release control from other clients
+)
+
+// Returns true if clients with this role may send control data and take over human control
+func (r Role) CanControl() bool {
+	return r == RoleController || r == RoleAdmin
+}
+
+// Returns true if clients with this role may override the control arbitration
+func (r Role) IsAdmin() bool {
+	return r == RoleAdmin
+}
+
+// The priority of clients with this role when they request control under the preemptive control policy
+func (r Role) ControlPriority() int {
+	switch r {
+	case RoleAdmin:
+		return 2
+	case RoleController:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func (r Role) valid() bool {
+	return r == RoleViewer || r == RoleController || r == RoleAdmin
+}
+
+type ClientClaims struct {
+	Subject   string `json:"sub,omitempty"`
+	Role      Role   `json:"role"`
+	Room      string `json:"room,omitempty"` // if set, the token is only valid for this room
+	ExpiresAt int64  `json:"exp,omitempty"`  // unix seconds
+	NotBefore int64  `json:"nbf,omitempty"`  // unix seconds
+}
+
+// Creates a signed token for the given claims (useful for tooling and for issuing tokens to clients)
+func SignClientToken(key []byte, claims ClientClaims) (string, error) {
+	return signToken(key, claims)
+}
+
+// Verifies a token from the Authorization header and returns its claims
+func VerifyClientToken(key []byte, authorization string, now time.Time) (*ClientClaims, error) {
+	claims := ClientClaims{}
+	if err := verifyToken(key, authorization, &claims); err != nil {
+		return nil, err
+	}
+	if err := checkValidity(claims.ExpiresAt, claims.NotBefore, now); err != nil {
+		return nil, err
+	}
+	if !claims.Role.valid() {
+		return nil, fmt.Errorf("%w: unknown role '%s'", ErrInvalidCredentials, claims.Role)
+	}
+
+	return &claims, nil
+}
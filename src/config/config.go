@@ -0,0 +1,541 @@
+package livestreamconfig
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"vu/ase/streamserver/src/control"
+
+	"github.com/pion/stun/v2"
+	"github.com/pion/webrtc/v4"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+//
+// The runtime configuration of the server. It is read from an (optional) YAML file, after which environment
+// variables can override individual values. See config.example.yaml for an overview of all options.
+//
+
+type Config struct {
+	Server    ServerConfig    `yaml:"server"`
+	WebRTC    WebRTCConfig    `yaml:"webrtc"`
+	Turn      TurnConfig      `yaml:"turn"`
+	Auth      AuthConfig      `yaml:"auth"`
+	Rooms     RoomsConfig     `yaml:"rooms"`
+	Control   ControlConfig   `yaml:"control"`
+	Stream    StreamConfig    `yaml:"stream"`
+	Recording RecordingConfig `yaml:"recording"`
+	Simulator SimulatorConfig `yaml:"simulator"`
+	Log       LogConfig       `yaml:"log"`
+}
+
+type ServerConfig struct {
+	Host         string        `yaml:"host"`
+	Port         int           `yaml:"port"`
+	ReadTimeout  time.Duration `yaml:"readTimeout"`
+	WriteTimeout time.Duration `yaml:"writeTimeout"`
+	IdleTimeout  time.Duration `yaml:"idleTimeout"`
+	CorsOrigins  []string      `yaml:"corsOrigins"` // origins that may use the HTTP endpoints, "*" allows all origins
+}
+
+type WebRTCConfig struct {
+	MuxUdpPorts         []int         `yaml:"muxUdpPorts"` // the UDP ports to use for ICE candidate multiplexing
+	NatIps              []string      `yaml:"natIps"`      // the IPs to advertise in host candidates (necessary when running through Docker)
+	IceServers          []ICEServer   `yaml:"iceServers"`
+	DisconnectedTimeout time.Duration `yaml:"disconnectedTimeout"`
+	FailedTimeout       time.Duration `yaml:"failedTimeout"`
+	KeepAliveInterval   time.Duration `yaml:"keepAliveInterval"`
+}
+
+type ICEServer struct {
+	URLs       []string `yaml:"urls"`
+	Username   string   `yaml:"username"`
+	Credential string   `yaml:"credential"`
+	// If a secret is set, time-limited credentials are generated (TURN REST API) instead of using the static credential
+	Secret        string        `yaml:"secret"`
+	CredentialTTL time.Duration `yaml:"credentialTTL"` // defaults to DefaultCredentialTTL
+}
+
+// The embedded TURN server, which relays traffic for peers that cannot reach the server (or each other) directly
+type TurnConfig struct {
+	Enabled      bool   `yaml:"enabled"`
+	Port         int    `yaml:"port"`     // the UDP port the TURN server listens on
+	PublicIp     string `yaml:"publicIp"` // the IP advertised to peers, defaults to the first of webrtc.natIps
+	Realm        string `yaml:"realm"`
+	Secret       string `yaml:"secret"`       // used to generate time-limited credentials, a random secret is used if empty
+	RelayMinPort int    `yaml:"relayMinPort"` // the UDP ports that are used for relayed connections
+	RelayMaxPort int    `yaml:"relayMaxPort"`
+	// Relaying to loopback, link-local and private addresses is denied (other than to this server), so that peers cannot
+	// use the TURN server to reach into the network of the server
+	AllowPrivatePeers bool `yaml:"allowPrivatePeers"`
+}
+
+type AuthConfig struct {
+	CarKey    string `yaml:"carKey"`    // the key cars use to sign their signaling requests, car requests are not verified if empty
+	ClientKey string `yaml:"clientKey"` // the key client tokens are signed with, clients are not verified if empty
+	// Signed car requests are rejected if their timestamp is further off than this, so that captured requests
+	// cannot be replayed later. 0 disables the check
+	CarRequestSkew time.Duration `yaml:"carRequestSkew"`
+}
+
+type RoomsConfig struct {
+	Max int `yaml:"max"`
+}
+
+type ControlConfig struct {
+	// Decides who gets control when a client requests it while another client holds it: exclusive, preemptive, queue or autonomous
+	Policy string `yaml:"policy"`
+	// The car is stopped if the active controller sends no control data for this long, 0 disables the watchdog.
+	// Cars are always stopped when their controller disconnects
+	WatchdogTimeout time.Duration `yaml:"watchdogTimeout"`
+	// Control is released if the active controller does not renew its lease (with control data or heartbeats) for this long, 0 disables expiry
+	LeaseTTL time.Duration `yaml:"leaseTTL"`
+	// Control is handed to the next client in the queue after a turn of this length (if anyone is waiting), 0 does not limit turns
+	MaxTurn     time.Duration `yaml:"maxTurn"`
+	StopMessage string        `yaml:"stopMessage"` // base64 encoded control message that stops the car, defaults to a controller output without throttle and steering
+}
+
+// How frames are delivered to the clients
+type StreamConfig struct {
+	// Every client has a queue of frames that still need to be sent to it. When a client cannot keep up,
+	// the oldest frames in its queue are dropped so that it does not fall further and further behind
+	FrameQueueSize int `yaml:"frameQueueSize"`
+	// Frames are left out for clients that cannot receive every frame within this time (e.g. on a bad link), 0 disables this
+	TargetLatency time.Duration `yaml:"targetLatency"`
+}
+
+type RecordingConfig struct {
+	Directory string `yaml:"directory"` // where recordings are stored, with a subdirectory per room
+}
+
+// A simulated car that connects to the server itself, so that clients can be tested without a physical car
+type SimulatorConfig struct {
+	Enabled     bool   `yaml:"enabled"`
+	CarId       string `yaml:"carId"`
+	Room        string `yaml:"room"`        // the room the car joins, the default room if empty
+	FrameRate   int    `yaml:"frameRate"`   // test pattern frames per second
+	Width       int    `yaml:"width"`       // of the test pattern, in pixels
+	Height      int    `yaml:"height"`      // of the test pattern, in pixels
+	EchoControl bool   `yaml:"echoControl"` // send received control messages back on the control channel, they are only logged otherwise
+}
+
+type LogConfig struct {
+	Level  string `yaml:"level"`  // trace, debug, info, warn or error
+	Output string `yaml:"output"` // path of the file to log to, logs to stderr if empty
+	Format string `yaml:"format"` // console or json
+}
+
+// Returns the configuration that is used when no configuration file or environment variables are given
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Host:         DefaultServerHost,
+			Port:         DefaultServerPort,
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 10 * time.Second,
+			IdleTimeout:  60 * time.Second,
+			CorsOrigins:  []string{"*"},
+		},
+		WebRTC: WebRTCConfig{
+			MuxUdpPorts: []int{DefaultMuxUdpPort},
+			NatIps:      []string{},
+			// By leaving out ICE servers, communication over LAN is possible
+			IceServers:          []ICEServer{},
+			DisconnectedTimeout: 5 * time.Second,
+			FailedTimeout:       25 * time.Second,
+			KeepAliveInterval:   2 * time.Second,
+		},
+		Turn: TurnConfig{
+			Enabled:      false,
+			Port:         DefaultTurnPort,
+			Realm:        "passthrough",
+			RelayMinPort: DefaultTurnRelayMinPort,
+			RelayMaxPort: DefaultTurnRelayMaxPort,
+		},
+		Auth: AuthConfig{
+			CarRequestSkew: DefaultCarRequestSkew,
+		},
+		Rooms: RoomsConfig{
+			Max: DefaultMaxRooms,
+		},
+		Control: ControlConfig{
+			Policy:          DefaultControlPolicy,
+			WatchdogTimeout: DefaultWatchdogTimeout,
+			LeaseTTL:        DefaultLeaseTTL,
+		},
+		Stream: StreamConfig{
+			FrameQueueSize: DefaultFrameQueueSize,
+			TargetLatency:  DefaultTargetLatency,
+		},
+		Recording: RecordingConfig{
+			Directory: DefaultRecordingDirectory,
+		},
+		Simulator: SimulatorConfig{
+			Enabled:   false,
+			CarId:     DefaultSimulatorCarId,
+			FrameRate: 10,
+			Width:     640,
+			Height:    480,
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "console",
+		},
+	}
+}
+
+// Reads the configuration file at path (if not empty), applies environment variable overrides and validates the result
+func Load(path string) (*Config, error) {
+	config := Default()
+
+	if path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read configuration file: %v", err)
+		}
+
+		decoder := yaml.NewDecoder(bytes.NewReader(content))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("Could not parse configuration file %s: %v", path, err)
+		}
+	}
+
+	if err := config.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid configuration: %v", err)
+	}
+	return config, nil
+}
+
+// Environment variables override the values from the configuration file
+func (c *Config) applyEnv() error {
+	var errs []error
+
+	envString := func(name string, target *string) {
+		if value, ok := os.LookupEnv(name); ok {
+			*target = value
+		}
+	}
+	envList := func(name string, target *[]string) {
+		if value, ok := os.LookupEnv(name); ok {
+			*target = splitList(value)
+		}
+	}
+	envInt := func(name string, target *int) {
+		if value, ok := os.LookupEnv(name); ok {
+			parsed, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s is not a number: %v", name, err))
+				return
+			}
+			*target = parsed
+		}
+	}
+	envBool := func(name string, target *bool) {
+		if value, ok := os.LookupEnv(name); ok {
+			parsed, err := strconv.ParseBool(strings.TrimSpace(value))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s is not a boolean: %v", name, err))
+				return
+			}
+			*target = parsed
+		}
+	}
+	envDuration := func(name string, target *time.Duration) {
+		if value, ok := os.LookupEnv(name); ok {
+			parsed, err := time.ParseDuration(strings.TrimSpace(value))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s is not a duration: %v", name, err))
+				return
+			}
+			*target = parsed
+		}
+	}
+
+	envString("ASE_FWSERVER_HOST", &c.Server.Host)
+	envInt("ASE_FWSERVER_PORT", &c.Server.Port)
+	envDuration("ASE_FWSERVER_READ_TIMEOUT", &c.Server.ReadTimeout)
+	envDuration("ASE_FWSERVER_WRITE_TIMEOUT", &c.Server.WriteTimeout)
+	envDuration("ASE_FWSERVER_IDLE_TIMEOUT", &c.Server.IdleTimeout)
+	envList("ASE_FWSERVER_CORS_ORIGINS", &c.Server.CorsOrigins)
+
+	// Kept for compatibility with existing deployments, this used to be the only way to configure the server
+	envList("ASE_FWSERVER_IP", &c.WebRTC.NatIps)
+	if value, ok := os.LookupEnv("ASE_FWSERVER_UDP_PORTS"); ok {
+		ports := make([]int, 0)
+		for _, port := range splitList(value) {
+			parsed, err := strconv.Atoi(port)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("ASE_FWSERVER_UDP_PORTS contains invalid port '%s'", port))
+				continue
+			}
+			ports = append(ports, parsed)
+		}
+		c.WebRTC.MuxUdpPorts = ports
+	}
+	if value, ok := os.LookupEnv("ASE_FWSERVER_ICE_SERVERS"); ok {
+		// All servers from the environment share the same credentials
+		c.WebRTC.IceServers = []ICEServer{}
+		for _, url := range splitList(value) {
+			c.WebRTC.IceServers = append(c.WebRTC.IceServers, ICEServer{
+				URLs:       []string{url},
+				Username:   os.Getenv("ASE_FWSERVER_ICE_USERNAME"),
+				Credential: os.Getenv("ASE_FWSERVER_ICE_CREDENTIAL"),
+				Secret:     os.Getenv("ASE_FWSERVER_ICE_SECRET"),
+			})
+		}
+		for i := range c.WebRTC.IceServers {
+			envDuration("ASE_FWSERVER_ICE_CREDENTIAL_TTL", &c.WebRTC.IceServers[i].CredentialTTL)
+		}
+	}
+	envDuration("ASE_FWSERVER_ICE_DISCONNECTED_TIMEOUT", &c.WebRTC.DisconnectedTimeout)
+	envDuration("ASE_FWSERVER_ICE_FAILED_TIMEOUT", &c.WebRTC.FailedTimeout)
+	envDuration("ASE_FWSERVER_ICE_KEEPALIVE_INTERVAL", &c.WebRTC.KeepAliveInterval)
+
+	envBool("ASE_FWSERVER_TURN_ENABLED", &c.Turn.Enabled)
+	envInt("ASE_FWSERVER_TURN_PORT", &c.Turn.Port)
+	envString("ASE_FWSERVER_TURN_PUBLIC_IP", &c.Turn.PublicIp)
+	envString("ASE_FWSERVER_TURN_REALM", &c.Turn.Realm)
+	envString("ASE_FWSERVER_TURN_SECRET", &c.Turn.Secret)
+	envInt("ASE_FWSERVER_TURN_RELAY_MIN_PORT", &c.Turn.RelayMinPort)
+	envInt("ASE_FWSERVER_TURN_RELAY_MAX_PORT", &c.Turn.RelayMaxPort)
+	envBool("ASE_FWSERVER_TURN_ALLOW_PRIVATE_PEERS", &c.Turn.AllowPrivatePeers)
+
+	envString("ASE_FWSERVER_CAR_KEY", &c.Auth.CarKey)
+	envString("ASE_FWSERVER_CLIENT_KEY", &c.Auth.ClientKey)
+	envDuration("ASE_FWSERVER_CAR_REQUEST_SKEW", &c.Auth.CarRequestSkew)
+
+	envInt("ASE_FWSERVER_MAX_ROOMS", &c.Rooms.Max)
+
+	envString("ASE_FWSERVER_CONTROL_POLICY", &c.Control.Policy)
+	envDuration("ASE_FWSERVER_WATCHDOG_TIMEOUT", &c.Control.WatchdogTimeout)
+	envString("ASE_FWSERVER_STOP_MESSAGE", &c.Control.StopMessage)
+	envDuration("ASE_FWSERVER_LEASE_TTL", &c.Control.LeaseTTL)
+	envDuration("ASE_FWSERVER_MAX_TURN", &c.Control.MaxTurn)
+
+	envInt("ASE_FWSERVER_FRAME_QUEUE_SIZE", &c.Stream.FrameQueueSize)
+	envDuration("ASE_FWSERVER_TARGET_LATENCY", &c.Stream.TargetLatency)
+
+	envString("ASE_FWSERVER_RECORDING_DIRECTORY", &c.Recording.Directory)
+
+	envBool("ASE_FWSERVER_SIMULATOR_ENABLED", &c.Simulator.Enabled)
+	envString("ASE_FWSERVER_SIMULATOR_CAR_ID", &c.Simulator.CarId)
+	envString("ASE_FWSERVER_SIMULATOR_ROOM", &c.Simulator.Room)
+	envInt("ASE_FWSERVER_SIMULATOR_FRAME_RATE", &c.Simulator.FrameRate)
+	envInt("ASE_FWSERVER_SIMULATOR_WIDTH", &c.Simulator.Width)
+	envInt("ASE_FWSERVER_SIMULATOR_HEIGHT", &c.Simulator.Height)
+	envBool("ASE_FWSERVER_SIMULATOR_ECHO_CONTROL", &c.Simulator.EchoControl)
+
+	envString("ASE_FWSERVER_LOG_LEVEL", &c.Log.Level)
+	envString("ASE_FWSERVER_LOG_OUTPUT", &c.Log.Output)
+	envString("ASE_FWSERVER_LOG_FORMAT", &c.Log.Format)
+
+	return errors.Join(errs...)
+}
+
+// Checks the configuration for values that would make the server fail at runtime
+func (c *Config) Validate() error {
+	var errs []error
+
+	if c.Server.Port <= 0 || c.Server.Port > 65535 {
+		errs = append(errs, fmt.Errorf("server.port %d is not a valid port", c.Server.Port))
+	}
+	if c.Server.ReadTimeout < 0 || c.Server.WriteTimeout < 0 || c.Server.IdleTimeout < 0 {
+		errs = append(errs, fmt.Errorf("server timeouts cannot be negative"))
+	}
+
+	if len(c.WebRTC.MuxUdpPorts) == 0 {
+		errs = append(errs, fmt.Errorf("webrtc.muxUdpPorts needs at least one port"))
+	}
+	for _, port := range c.WebRTC.MuxUdpPorts {
+		if port <= 0 || port > 65535 {
+			errs = append(errs, fmt.Errorf("webrtc.muxUdpPorts contains invalid port %d", port))
+		}
+	}
+	if len(c.WebRTC.NatIps) == 0 {
+		errs = append(errs, fmt.Errorf("webrtc.natIps is empty. Please set it (or the ASE_FWSERVER_IP environment variable) to your local IP address (192.168.0.XXX)"))
+	}
+	for _, ip := range c.WebRTC.NatIps {
+		if net.ParseIP(ip) == nil {
+			errs = append(errs, fmt.Errorf("webrtc.natIps contains invalid IP address '%s'", ip))
+		}
+	}
+	for i, server := range c.WebRTC.IceServers {
+		if len(server.URLs) == 0 {
+			errs = append(errs, fmt.Errorf("webrtc.iceServers[%d] has no urls", i))
+		}
+		for _, url := range server.URLs {
+			uri, err := stun.ParseURI(url)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("webrtc.iceServers[%d] has invalid url '%s': %v", i, url, err))
+				continue
+			}
+
+			if isTurnURI(uri) && server.Secret == "" && (server.Username == "" || server.Credential == "") {
+				errs = append(errs, fmt.Errorf("webrtc.iceServers[%d] is a TURN server and needs a username and credential, or a secret", i))
+			}
+		}
+		if server.CredentialTTL < 0 {
+			errs = append(errs, fmt.Errorf("webrtc.iceServers[%d] cannot have a negative credentialTTL", i))
+		}
+	}
+	if c.WebRTC.DisconnectedTimeout <= 0 || c.WebRTC.FailedTimeout <= 0 || c.WebRTC.KeepAliveInterval <= 0 {
+		errs = append(errs, fmt.Errorf("webrtc timeouts need to be positive"))
+	}
+
+	if c.Turn.Enabled {
+		if c.Turn.Port <= 0 || c.Turn.Port > 65535 {
+			errs = append(errs, fmt.Errorf("turn.port %d is not a valid port", c.Turn.Port))
+		}
+		if c.Turn.PublicIp != "" && net.ParseIP(c.Turn.PublicIp) == nil {
+			errs = append(errs, fmt.Errorf("turn.publicIp '%s' is not a valid IP address", c.Turn.PublicIp))
+		}
+		if c.Turn.RelayMinPort <= 0 || c.Turn.RelayMaxPort > 65535 || c.Turn.RelayMinPort > c.Turn.RelayMaxPort {
+			errs = append(errs, fmt.Errorf("turn.relayMinPort and turn.relayMaxPort need to form a valid port range"))
+		}
+		if c.Turn.Realm == "" {
+			errs = append(errs, fmt.Errorf("turn.realm cannot be empty"))
+		}
+	}
+
+	if c.Auth.CarRequestSkew < 0 {
+		errs = append(errs, fmt.Errorf("auth.carRequestSkew cannot be negative"))
+	}
+
+	if c.Rooms.Max <= 0 {
+		errs = append(errs, fmt.Errorf("rooms.max needs to be at least 1"))
+	}
+
+	if _, err := control.NewPolicy(c.Control.Policy); err != nil {
+		errs = append(errs, fmt.Errorf("control.policy: %v", err))
+	}
+	if c.Control.WatchdogTimeout < 0 {
+		errs = append(errs, fmt.Errorf("control.watchdogTimeout cannot be negative"))
+	}
+	if c.Control.LeaseTTL < 0 {
+		errs = append(errs, fmt.Errorf("control.leaseTTL cannot be negative"))
+	}
+	if c.Control.MaxTurn < 0 {
+		errs = append(errs, fmt.Errorf("control.maxTurn cannot be negative"))
+	}
+	if _, err := base64.StdEncoding.DecodeString(c.Control.StopMessage); err != nil {
+		errs = append(errs, fmt.Errorf("control.stopMessage is not base64 encoded: %v", err))
+	}
+
+	if c.Stream.FrameQueueSize <= 0 {
+		errs = append(errs, fmt.Errorf("stream.frameQueueSize needs to be at least 1"))
+	}
+	if c.Stream.TargetLatency < 0 {
+		errs = append(errs, fmt.Errorf("stream.targetLatency cannot be negative"))
+	}
+
+	if c.Recording.Directory == "" {
+		errs = append(errs, fmt.Errorf("recording.directory cannot be empty"))
+	}
+
+	// The simulator can still be enabled from the command line, so its configuration is always checked
+	if c.Simulator.CarId == "" {
+		errs = append(errs, fmt.Errorf("simulator.carId cannot be empty"))
+	}
+	if c.Simulator.FrameRate <= 0 || c.Simulator.FrameRate > 60 {
+		errs = append(errs, fmt.Errorf("simulator.frameRate needs to be between 1 and 60"))
+	}
+	if c.Simulator.Width < 16 || c.Simulator.Height < 16 || c.Simulator.Width > 3840 || c.Simulator.Height > 2160 {
+		errs = append(errs, fmt.Errorf("simulator.width and simulator.height need to be between 16x16 and 3840x2160"))
+	}
+
+	if _, err := zerolog.ParseLevel(c.Log.Level); err != nil || c.Log.Level == "" {
+		errs = append(errs, fmt.Errorf("log.level '%s' is not a valid log level", c.Log.Level))
+	}
+	if c.Log.Format != "console" && c.Log.Format != "json" {
+		errs = append(errs, fmt.Errorf("log.format '%s' needs to be either console or json", c.Log.Format))
+	}
+
+	return errors.Join(errs...)
+}
+
+// The address the HTTP server binds to
+func (c *Config) ServerAddress() string {
+	return net.JoinHostPort(c.Server.Host, strconv.Itoa(c.Server.Port))
+}
+
+// The configuration used for every peer connection, with fresh credentials for the ICE servers
+func (c *Config) PeerConnectionConfig(now time.Time) webrtc.Configuration {
+	iceServers := make([]webrtc.ICEServer, 0, len(c.WebRTC.IceServers))
+	for _, server := range c.WebRTC.IceServers {
+		iceServers = append(iceServers, server.WithCredentials(now))
+	}
+
+	return webrtc.Configuration{
+		ICEServers: iceServers,
+	}
+}
+
+// Returns the ICE server with the credentials a peer should use at the given time.
+// With a secret, the credentials follow the TURN REST API: the username is "<expiry>:<username>"
+// and the credential is the base64 encoded HMAC-SHA1 of the username, so that any TURN server sharing the secret accepts them
+func (s ICEServer) WithCredentials(now time.Time) webrtc.ICEServer {
+	server := webrtc.ICEServer{
+		URLs:       s.URLs,
+		Username:   s.Username,
+		Credential: s.Credential,
+	}
+	if s.Secret == "" || !s.isTurn() {
+		return server
+	}
+
+	ttl := s.CredentialTTL
+	if ttl == 0 {
+		ttl = DefaultCredentialTTL
+	}
+	expiry := strconv.FormatInt(now.Add(ttl).Unix(), 10)
+	server.Username = expiry
+	if s.Username != "" {
+		server.Username = expiry + ":" + s.Username
+	}
+
+	mac := hmac.New(sha1.New, []byte(s.Secret))
+	mac.Write([]byte(server.Username))
+	server.Credential = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return server
+}
+
+// Returns true if any of the urls points to a TURN server (only those need credentials)
+func (s ICEServer) isTurn() bool {
+	for _, url := range s.URLs {
+		if uri, err := stun.ParseURI(url); err == nil && isTurnURI(uri) {
+			return true
+		}
+	}
+	return false
+}
+
+func isTurnURI(uri *stun.URI) bool {
+	return uri.Scheme == stun.SchemeTypeTURN || uri.Scheme == stun.SchemeTypeTURNS
+}
+
+// Splits a comma separated list, ignoring empty elements
+func splitList(value string) []string {
+	list := make([]string, 0)
+	for _, element := range strings.Split(value, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			list = append(list, element)
+		}
+	}
+	return list
+}
@@ -1,37 +1,55 @@
 package livestreamconfig
 
 import (
-	"fmt"
+	"time"
 
-	"github.com/pion/webrtc/v4"
+	"vu/ase/streamserver/src/control"
 )
 
 const (
-	// The server address to bind to
-	ServerScheme = "http"
-	ServerHost   = "0.0.0.0"
-	ServerPort   = 7500
-
-	// Used to identify the car connection
-	CarId = "car"
+	// The default server address to bind to
+	ServerScheme      = "http"
+	DefaultServerHost = "0.0.0.0"
+	DefaultServerPort = 7500
+
+	// The room that is used by the endpoints that are not scoped to a room, and the default maximum number of rooms
+	DefaultRoomId   = "default"
+	DefaultMaxRooms = 32
+
+	// Who gets control when a client requests it while another client holds it, by default
+	DefaultControlPolicy = control.PolicyQueue
+	// How long the active controller can stay silent before its car is stopped, by default
+	DefaultWatchdogTimeout = 1 * time.Second
+	// How long human control lasts after the active controller last renewed it, by default
+	DefaultLeaseTTL = 10 * time.Second
+	// How far the timestamp of a signed car request may be off from the clock of the server, by default
+	DefaultCarRequestSkew = 30 * time.Second
+
+	// How many frames can be queued for a client by default, before the oldest frames are dropped
+	DefaultFrameQueueSize = 4
+	// How long a frame may take to reach a client by default, before frames are left out for that client
+	DefaultTargetLatency = 250 * time.Millisecond
+
+	// Where recordings are stored by default (relative to the working directory)
+	DefaultRecordingDirectory = "recordings"
+
+	// The id the simulated car uses by default
+	DefaultSimulatorCarId = "simulated-car"
 
 	// Used to identify the different data channels
 	MetaChannelLabel    = "meta"
 	ControlChannelLabel = "control"
 	FrameChannelLabel   = "frame"
 
-	// The UDP port to use for ICE candidate multiplexing
-	// Updating this value also requires updating your Dockerfile and docker-compose.yaml
-	MuxUdpPort = 40000
-)
+	// How long generated TURN credentials stay valid by default
+	DefaultCredentialTTL = 12 * time.Hour
 
-var ServerAddres = fmt.Sprintf("%s://%s:%d", ServerScheme, ServerHost, ServerPort)
+	// The default UDP port to use for ICE candidate multiplexing
+	// Updating this value also requires updating your Dockerfile and docker-compose.yaml
+	DefaultMuxUdpPort = 40000
 
-// By commenting out the ICE server, communication over LAN is possible
-var PeerConnectionConfig = webrtc.Configuration{
-	ICEServers: []webrtc.ICEServer{
-		// {
-		// 	URLs: []string{"stun:stun.l.google.com:19302"},
-		// },
-	},
-}
+	// The default ports of the embedded TURN server (if enabled)
+	DefaultTurnPort         = 3478
+	DefaultTurnRelayMinPort = 49160
+	DefaultTurnRelayMaxPort = 49200
+)
@@ -0,0 +1,65 @@
+package control
+
+import (
+	"sync"
+	"time"
+)
+
+//
+// Privileged control actions (an admin taking over or revoking control) are audited, so that it can be traced afterwards
+// who interfered with whose control and why. The most recent entries are kept in memory, every entry is also logged.
+//
+
+// The number of entries that is kept per room
+const maxAuditEntries = 200
+
+// Actions that are audited
+const (
+	AuditForceTakeover = "forceTakeover" // an admin took over control from the active controller
+	AuditRevoke        = "revoke"        // an admin took control away from a client
+)
+
+type AuditEntry struct {
+	Time         int64  `json:"time"` // unix milliseconds
+	Action       string `json:"action"`
+	AdminId      string `json:"adminId"`      // the admin that performed the action
+	ControllerId string `json:"controllerId"` // the client that lost control, empty if nobody had control
+	Reason       string `json:"reason,omitempty"`
+}
+
+type AuditLog struct {
+	entries []AuditEntry
+	lock    *sync.Mutex
+}
+
+func NewAuditLog() *AuditLog {
+	return &AuditLog{
+		entries: make([]AuditEntry, 0),
+		lock:    &sync.Mutex{},
+	}
+}
+
+// Adds an entry to the log, the oldest entry is dropped if the log is full. The time of the entry is set if it is missing
+func (a *AuditLog) Add(entry AuditEntry) AuditEntry {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if entry.Time == 0 {
+		entry.Time = time.Now().UnixMilli()
+	}
+	if len(a.entries) >= maxAuditEntries {
+		a.entries = a.entries[1:]
+	}
+	a.entries = append(a.entries, entry)
+	return entry
+}
+
+// Returns the entries in the log, oldest first
+func (a *AuditLog) Entries() []AuditEntry {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	entries := make([]AuditEntry, len(a.entries))
+	copy(entries, a.entries)
+	return entries
+}
@@ -0,0 +1,120 @@
+package control
+
+import (
+	"sync"
+	"time"
+)
+
+//
+// Human control is a lease: the controller that holds it needs to renew it (by sending control data or heartbeats)
+// before it runs out, otherwise control is released for it. This way, control does not stay with a controller
+// that went away until its peer connection fails.
+//
+
+// Describes the lease of the active controller
+type LeaseState struct {
+	ControllerId string `json:"controllerId"` // empty if nobody holds control
+	Remaining    int64  `json:"remaining"`    // milliseconds until the lease expires, 0 if it never expires
+	TTL          int64  `json:"ttl"`          // milliseconds a lease lasts after it was renewed, 0 if it never expires
+}
+
+type Lease struct {
+	ttl       time.Duration // 0 disables expiry
+	holder    string        // empty if nobody holds the lease
+	expiresAt time.Time
+	timer     *time.Timer
+	lock      *sync.Mutex
+}
+
+func NewLease(ttl time.Duration) *Lease {
+	return &Lease{
+		ttl:  ttl,
+		lock: &sync.Mutex{},
+	}
+}
+
+// Gives the lease to a controller, replacing the current holder. If the lease is not renewed in time,
+// onExpire is called with the holder after the lease was taken away from it
+func (l *Lease) Grant(holder string, onExpire func(holder string)) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.stopTimer()
+	l.holder = holder
+	if l.ttl <= 0 {
+		return
+	}
+
+	l.expiresAt = time.Now().Add(l.ttl)
+	var timer *time.Timer
+	timer = time.AfterFunc(l.ttl, func() {
+		l.lock.Lock()
+		// The lease might have been renewed, revoked or granted to someone else just before the timer fired
+		if l.timer != timer {
+			l.lock.Unlock()
+			return
+		}
+		// Renewals only move the expiry time, so the timer might have fired too early
+		if remaining := time.Until(l.expiresAt); remaining > 0 {
+			timer.Reset(remaining)
+			l.lock.Unlock()
+			return
+		}
+		holder := l.holder
+		l.holder = ""
+		l.timer = nil
+		l.lock.Unlock()
+
+		onExpire(holder)
+	})
+	l.timer = timer
+}
+
+// Extends the lease of the holder by the TTL. Returns false if the controller does not hold the lease
+func (l *Lease) Renew(holder string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if holder == "" || l.holder != holder {
+		return false
+	}
+	if l.ttl > 0 {
+		l.expiresAt = time.Now().Add(l.ttl)
+	}
+	return true
+}
+
+// Takes the lease away from the holder, without calling onExpire. Returns false if the controller does not hold the lease
+func (l *Lease) Revoke(holder string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if holder == "" || l.holder != holder {
+		return false
+	}
+	l.stopTimer()
+	l.holder = ""
+	return true
+}
+
+func (l *Lease) State() LeaseState {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	state := LeaseState{
+		ControllerId: l.holder,
+		TTL:          l.ttl.Milliseconds(),
+	}
+	if l.holder != "" && l.ttl > 0 {
+		state.Remaining = max(1, time.Until(l.expiresAt).Milliseconds())
+	}
+	return state
+}
+
+// The caller needs to hold the lock
+func (l *Lease) stopTimer() {
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+}
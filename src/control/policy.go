@@ -0,0 +1,129 @@
+package control
+
+import (
+	"fmt"
+	"strings"
+)
+
+//
+// A policy decides who gets human control when a client requests it while another client holds it. The server
+// chooses one policy for all rooms (see the control.policy configuration), the mechanics of handing over control
+// (leases, queues and turns) are the same for every policy.
+//
+
+// The policies that can be configured
+const (
+	PolicyExclusive  = "exclusive"  // the first client to take over control keeps it until it releases it, other requests are denied
+	PolicyPreemptive = "preemptive" // clients with a higher priority take control away from clients with a lower priority, others wait in the queue
+	PolicyQueue      = "queue"      // clients wait in the queue until the active controller releases control or its turn is over
+	PolicyAutonomous = "autonomous" // the car drives itself until a client takes over, and goes back to driving itself when control is released
+)
+
+// The names of all policies that can be configured
+var PolicyNames = []string{PolicyExclusive, PolicyPreemptive, PolicyQueue, PolicyAutonomous}
+
+// What happens to a control request
+type Decision int
+
+const (
+	Deny    Decision = iota // the requester does not get control
+	Grant                   // the requester gets control, the active controller (if any) loses it
+	Enqueue                 // the requester waits in the queue until control is handed to it
+)
+
+func (d Decision) String() string {
+	switch d {
+	case Deny:
+		return "deny"
+	case Grant:
+		return "grant"
+	case Enqueue:
+		return "enqueue"
+	default:
+		return fmt.Sprintf("Decision(%d)", int(d))
+	}
+}
+
+// A client that holds or requests control
+type Contender struct {
+	Id       string
+	Priority int // only used by the preemptive policy, a higher priority wins
+}
+
+type Policy interface {
+	Name() string
+	// Decides on the control request of a client, holder is nil if nobody (else) holds control
+	Decide(requester Contender, holder *Contender) Decision
+	// Returns true if the car drives itself while nobody holds control. Such a car is handed back to its own driving
+	// instead of being stopped when its controller goes away
+	Autonomous() bool
+}
+
+// Returns the policy with the given name
+func NewPolicy(name string) (Policy, error) {
+	switch name {
+	case PolicyExclusive:
+		return exclusivePolicy{}, nil
+	case PolicyPreemptive:
+		return preemptivePolicy{}, nil
+	case PolicyQueue:
+		return queuePolicy{}, nil
+	case PolicyAutonomous:
+		return autonomousPolicy{}, nil
+	default:
+		return nil, fmt.Errorf("Unknown control policy '%s', needs to be one of %s", name, strings.Join(PolicyNames, ", "))
+	}
+}
+
+type exclusivePolicy struct{}
+
+func (exclusivePolicy) Name() string { return PolicyExclusive }
+
+func (exclusivePolicy) Decide(requester Contender, holder *Contender) Decision {
+	if holder == nil || holder.Id == requester.Id {
+		return Grant
+	}
+	return Deny
+}
+
+func (exclusivePolicy) Autonomous() bool { return false }
+
+type preemptivePolicy struct{}
+
+func (preemptivePolicy) Name() string { return PolicyPreemptive }
+
+func (preemptivePolicy) Decide(requester Contender, holder *Contender) Decision {
+	if holder == nil || holder.Id == requester.Id || requester.Priority > holder.Priority {
+		return Grant
+	}
+	return Enqueue
+}
+
+func (preemptivePolicy) Autonomous() bool { return false }
+
+type queuePolicy struct{}
+
+func (queuePolicy) Name() string { return PolicyQueue }
+
+func (queuePolicy) Decide(requester Contender, holder *Contender) Decision {
+	if holder == nil || holder.Id == requester.Id {
+		return Grant
+	}
+	return Enqueue
+}
+
+func (queuePolicy) Autonomous() bool { return false }
+
+// Humans override the car one at a time: while a client holds control, other requests are denied
+type autonomousPolicy struct{}
+
+func (autonomousPolicy) Name() string { return PolicyAutonomous }
+
+func (autonomousPolicy) Decide(requester Contender, holder *Contender) Decision {
+	if holder == nil || holder.Id == requester.Id {
+		return Grant
+	}
+	return Deny
+}
+
+func (autonomousPolicy) Autonomous() bool { return true }
@@ -0,0 +1,84 @@
+package control
+
+import "testing"
+
+func TestNewPolicy(t *testing.T) {
+	for _, name := range PolicyNames {
+		policy, err := NewPolicy(name)
+		if err != nil {
+			t.Fatalf("NewPolicy(%q) returned error: %v", name, err)
+		}
+		if policy.Name() != name {
+			t.Errorf("NewPolicy(%q).Name() = %q", name, policy.Name())
+		}
+	}
+
+	if _, err := NewPolicy("fastest-finger"); err == nil {
+		t.Error("NewPolicy accepted an unknown policy")
+	}
+}
+
+func TestPolicyDecide(t *testing.T) {
+	controller := Contender{Id: "controller", Priority: 1}
+	otherController := Contender{Id: "other", Priority: 1}
+	admin := Contender{Id: "admin", Priority: 2}
+
+	tests := []struct {
+		policy    string
+		requester Contender
+		holder    *Contender
+		want      Decision
+	}{
+		// Nobody holds control, so every policy grants it
+		{PolicyExclusive, controller, nil, Grant},
+		{PolicyPreemptive, controller, nil, Grant},
+		{PolicyQueue, controller, nil, Grant},
+		{PolicyAutonomous, controller, nil, Grant},
+
+		// The holder requests control again
+		{PolicyExclusive, controller, &controller, Grant},
+		{PolicyPreemptive, controller, &controller, Grant},
+		{PolicyQueue, controller, &controller, Grant},
+		{PolicyAutonomous, controller, &controller, Grant},
+
+		// Someone else holds control
+		{PolicyExclusive, otherController, &controller, Deny},
+		{PolicyExclusive, admin, &controller, Deny},
+		{PolicyPreemptive, otherController, &controller, Enqueue},
+		{PolicyPreemptive, admin, &controller, Grant},
+		{PolicyPreemptive, controller, &admin, Enqueue},
+		{PolicyQueue, otherController, &controller, Enqueue},
+		{PolicyQueue, admin, &controller, Enqueue},
+		{PolicyAutonomous, otherController, &controller, Deny},
+		{PolicyAutonomous, admin, &controller, Deny},
+	}
+
+	for _, test := range tests {
+		policy, err := NewPolicy(test.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		holder := "nobody"
+		if test.holder != nil {
+			holder = test.holder.Id
+		}
+		if got := policy.Decide(test.requester, test.holder); got != test.want {
+			t.Errorf("%s: %s requesting control from %s = %v, want %v", test.policy, test.requester.Id, holder, got, test.want)
+		}
+	}
+}
+
+func TestPolicyAutonomous(t *testing.T) {
+	for name, want := range map[string]bool{
+		PolicyExclusive:  false,
+		PolicyPreemptive: false,
+		PolicyQueue:      false,
+		PolicyAutonomous: true,
+	} {
+		policy, _ := NewPolicy(name)
+		if policy.Autonomous() != want {
+			t.Errorf("%s: Autonomous() = %v, want %v", name, policy.Autonomous(), want)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package control
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+//
+// Clients that request control while someone else holds it wait in a queue, first come first served.
+// Turns can be limited in length, so that everyone in a busy room gets to drive.
+//
+
+// Describes the queue as seen by one client
+type QueueState struct {
+	Waiting       []string `json:"waiting"`       // the ids of the waiting clients, next in line first
+	Position      int      `json:"position"`      // the position of the client in the queue (starting at 1), 0 if it is not waiting
+	MaxTurn       int64    `json:"maxTurn"`       // milliseconds a turn lasts when others are waiting, 0 if turns are not limited
+	TurnRemaining int64    `json:"turnRemaining"` // milliseconds until the turn of the active controller ends, 0 if it is not limited
+}
+
+type Queue struct {
+	maxTurn       time.Duration // 0 does not limit turns
+	waiting       []string
+	turnHolder    string // the controller whose turn is timed, empty if nobody has a turn
+	turnStartedAt time.Time
+	turnTimer     *time.Timer
+	lock          *sync.Mutex
+}
+
+func NewQueue(maxTurn time.Duration) *Queue {
+	return &Queue{
+		maxTurn: maxTurn,
+		waiting: make([]string, 0),
+		lock:    &sync.Mutex{},
+	}
+}
+
+// Adds a client to the end of the queue and returns its position. A client that is already waiting keeps its position
+func (q *Queue) Enqueue(id string) int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if i := slices.Index(q.waiting, id); i >= 0 {
+		return i + 1
+	}
+	q.waiting = append(q.waiting, id)
+	return len(q.waiting)
+}
+
+// Removes a client from the queue, returns false if it was not waiting
+func (q *Queue) Remove(id string) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	i := slices.Index(q.waiting, id)
+	if i < 0 {
+		return false
+	}
+	q.waiting = slices.Delete(q.waiting, i, i+1)
+	return true
+}
+
+// Removes the client that is next in line from the queue and returns it, returns false if nobody is waiting
+func (q *Queue) Next() (string, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if len(q.waiting) == 0 {
+		return "", false
+	}
+	next := q.waiting[0]
+	q.waiting = q.waiting[1:]
+	return next, true
+}
+
+// Returns true if nobody is waiting
+func (q *Queue) Empty() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return len(q.waiting) == 0
+}
+
+// Starts the turn of a controller. If turns are limited, onTurnOver is called with the controller when its turn is over,
+// it is up to the caller to decide whether control is handed over (e.g. only if someone is waiting)
+func (q *Queue) StartTurn(holder string, onTurnOver func(holder string)) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.stopTimer()
+	q.turnHolder = holder
+	q.turnStartedAt = time.Now()
+	if q.maxTurn <= 0 {
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(q.maxTurn, func() {
+		q.lock.Lock()
+		if q.turnTimer != timer {
+			q.lock.Unlock()
+			return
+		}
+		q.turnTimer = nil
+		q.lock.Unlock()
+
+		onTurnOver(holder)
+	})
+	q.turnTimer = timer
+}
+
+// Ends the turn of a controller, if it has one
+func (q *Queue) EndTurn(holder string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if holder == "" || q.turnHolder != holder {
+		return
+	}
+	q.stopTimer()
+	q.turnHolder = ""
+}
+
+// Returns true if turns are limited and the turn of the controller lasted longer than allowed
+func (q *Queue) TurnOver(holder string) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.maxTurn > 0 && holder != "" && q.turnHolder == holder && time.Since(q.turnStartedAt) >= q.maxTurn
+}
+
+// Describes the queue as seen by the given client
+func (q *Queue) State(id string) QueueState {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	state := QueueState{
+		Waiting:  slices.Clone(q.waiting),
+		Position: slices.Index(q.waiting, id) + 1,
+		MaxTurn:  q.maxTurn.Milliseconds(),
+	}
+	if q.maxTurn > 0 && q.turnHolder != "" {
+		state.TurnRemaining = max(0, (q.maxTurn - time.Since(q.turnStartedAt)).Milliseconds())
+	}
+	return state
+}
+
+// The caller needs to hold the lock
+func (q *Queue) stopTimer() {
+	if q.turnTimer != nil {
+		q.turnTimer.Stop()
+		q.turnTimer = nil
+	}
+}
@@ -0,0 +1,103 @@
+package control
+
+import (
+	"sync"
+	"time"
+
+	pb_module_outputs "github.com/VU-ASE/rovercom/packages/go/outputs"
+
+	"google.golang.org/protobuf/proto"
+)
+
+//
+// The watchdog is a dead man's switch for the active controller: every control message it sends feeds the watchdog,
+// and if the controller goes silent for longer than the timeout, the car it was controlling needs to be stopped.
+// The watchdog only keeps time, stopping the car is up to the caller.
+//
+
+type Watchdog struct {
+	timeout      time.Duration // 0 disables the timer, the watched car is still tracked
+	controllerId string        // the controller that is watched, empty if the watchdog is disarmed
+	carId        string        // the car that last received control data from the controller
+	timer        *time.Timer
+	lock         *sync.Mutex
+}
+
+func NewWatchdog(timeout time.Duration) *Watchdog {
+	return &Watchdog{
+		timeout: timeout,
+		lock:    &sync.Mutex{},
+	}
+}
+
+// Called for every control message of the active controller. If no other message follows within the timeout,
+// onExpire is called with the controller and the car it was controlling, after which the watchdog is disarmed
+func (w *Watchdog) Feed(controllerId string, carId string, onExpire func(controllerId string, carId string)) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.stopTimer()
+	w.controllerId = controllerId
+	w.carId = carId
+	if w.timeout <= 0 {
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(w.timeout, func() {
+		w.lock.Lock()
+		// The controller might have sent another message just before the timer fired
+		if w.timer != timer {
+			w.lock.Unlock()
+			return
+		}
+		controllerId, carId := w.controllerId, w.carId
+		w.disarm()
+		w.lock.Unlock()
+
+		onExpire(controllerId, carId)
+	})
+	w.timer = timer
+}
+
+// Stops watching the given controller. Returns the car it was controlling, or false if the controller was not watched
+func (w *Watchdog) Disarm(controllerId string) (string, bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if controllerId == "" || w.controllerId != controllerId {
+		return "", false
+	}
+	carId := w.carId
+	w.disarm()
+	return carId, true
+}
+
+// The caller needs to hold the lock
+func (w *Watchdog) disarm() {
+	w.stopTimer()
+	w.controllerId = ""
+	w.carId = ""
+}
+
+// The caller needs to hold the lock
+func (w *Watchdog) stopTimer() {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+}
+
+// The control message that is sent to stop a car when no stop message is configured: a controller output without
+// throttle and steering, as the controller of the car would produce it
+func DefaultStopMessage() ([]byte, error) {
+	return proto.Marshal(&pb_module_outputs.SensorOutput{
+		SensorOutput: &pb_module_outputs.SensorOutput_ControllerOutput{
+			ControllerOutput: &pb_module_outputs.ControllerOutput{
+				SteeringAngle: 0,
+				LeftThrottle:  0,
+				RightThrottle: 0,
+			},
+		},
+	})
+}
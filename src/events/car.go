@@ -3,9 +3,13 @@ package events
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 
 	livestreamconfig "vu/ase/streamserver/src/config"
+	"vu/ase/streamserver/src/fanout"
+	"vu/ase/streamserver/src/media"
 	"vu/ase/streamserver/src/peerconnection"
+	"vu/ase/streamserver/src/recording"
 	"vu/ase/streamserver/src/state"
 
 	pb_remote_config_messages "github.com/VU-ASE/rovercom/packages/go"
@@ -17,9 +21,33 @@ import (
 )
 
 // Called when a car sends an offer to the HTTP server
-func OnCarSDPReceived(sdp rtc.RequestSDP, receivedAt int64, state *state.ServerState) ([]byte, error) {
+func OnCarSDPReceived(sdp CarRequestSDP, receivedAt int64, room *state.Room) ([]byte, error) {
+	var gatherer *peerconnection.Gatherer
+	if sdp.Trickle {
+		gatherer = peerconnection.NewGatherer()
+	}
+
+	answer, err := connectCar(sdp, receivedAt, gatherer, room)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(answer)
+}
+
+// Creates the connection for a car offer and returns the answer, this is shared by all signaling methods.
+// If a gatherer is given, trickle ICE is used
+func connectCar(sdp CarRequestSDP, receivedAt int64, gatherer *peerconnection.Gatherer, room *state.Room) (*AnswerSDP, error) {
+	// Car ids cannot collide with client session ids
+	if sdp.Id == "" || state.IsSessionId(sdp.Id) {
+		return nil, fmt.Errorf("Invalid car id '%s'", sdp.Id)
+	}
+	if room.GetPlayer(sdp.Id) != nil {
+		return nil, fmt.Errorf("Car id '%s' is used by a replay", sdp.Id)
+	}
+
 	// Create a new RTCPeerConnection
-	rtc, err := peerconnection.CreateFromOffer(sdp.Offer, sdp.Id, livestreamconfig.PeerConnectionConfig, state.RtcApi)
+	rtc, err := peerconnection.CreateFromOffer(sdp.Offer, sdp.Id, room.Server.PeerConnectionConfig(), room.Server.RtcApi, gatherer, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -29,34 +57,49 @@ func OnCarSDPReceived(sdp rtc.RequestSDP, receivedAt int64, state *state.ServerS
 
 	log := rtc.Log()
 
-	// Register event handlers from now on
-	rtc.Pc.OnConnectionStateChange(onCarConnectionChange(rtc, state))
+	log.Info().Str("roomId", room.Id).Msg("Received SDP offer from car")
 
-	log.Info().Msg("Received SDP offer from car")
-
-	// Add rtc to list of car connections (there can be only one car connection)
-	err = state.ConnectedPeers.Add(livestreamconfig.CarId, rtc, true)
-	if err != nil {
+	// Add rtc to list of car connections, an active car connection with the same id is never overwritten
+	if err := removeStaleCar(sdp.Id, room); err != nil {
+		rtc.Destroy()
 		return nil, err
 	}
-
-	// Register data channel creation and other handlers
-	OnCarSDPReturned(rtc, state)
-
-	// Send answer back to car
-	payload, err := json.Marshal(rtc.Pc.LocalDescription())
+	err = room.ConnectedCars.Add(sdp.Id, rtc, true)
 	if err != nil {
+		rtc.Destroy()
 		return nil, err
 	}
 
-	return payload, nil
+	if gatherer != nil {
+		room.SetGatherer(sdp.Id, gatherer)
+	}
+	room.UpdateCarStatus(sdp.Id, func(status *state.CarStatus) {
+		status.ServerMessages = sdp.ServerMessages
+	})
+
+	// Forward the media tracks the car publishes to its subscribers
+	forwarder := media.NewForwarder(sdp.Id)
+	room.SetForwarder(sdp.Id, forwarder)
+	rtc.Pc.OnTrack(onCarTrack(rtc, forwarder, room))
+
+	// Register event handlers from now on
+	rtc.Pc.OnConnectionStateChange(onCarConnectionChange(rtc, room))
+
+	// Register data channel creation and other handlers
+	OnCarSDPReturned(rtc, room)
+
+	// Send answer back to car, cars keep using their own (authenticated) id as session id
+	return &AnswerSDP{
+		SessionDescription: *rtc.Pc.LocalDescription(),
+		SessionId:          rtc.Id,
+	}, nil
 }
 
 // Called when a car sends an ICE candidate to the HTTP server
-func OnCarICEReceived(ice rtc.RequestICE, state *state.ServerState) ([]byte, error) {
+func OnCarICEReceived(ice rtc.RequestICE, room *state.Room) ([]byte, error) {
 	// Get connection from list of connections
-	rtc := state.ConnectedPeers.Get(livestreamconfig.CarId)
-	if rtc == nil {
+	rtc := room.ConnectedCars.Get(ice.Id)
+	if rtc == nil || rtc.Pc == nil {
 		return nil, fmt.Errorf("Car connection with id %s does not exist", ice.Id)
 	}
 
@@ -69,8 +112,12 @@ func OnCarICEReceived(ice rtc.RequestICE, state *state.ServerState) ([]byte, err
 
 	log.Info().Msg("Received ICE candidates from car")
 
-	// Return all candidates to client
-	payload, err := json.Marshal(rtc.GetAllLocalCandidates())
+	// Return all candidates to the car, unless it uses trickle ICE (then it fetches them from the candidates endpoint)
+	candidates := rtc.GetAllLocalCandidates()
+	if room.GetGatherer(rtc.Id) != nil {
+		candidates = []webrtc.ICECandidateInit{}
+	}
+	payload, err := json.Marshal(candidates)
 	if err != nil {
 		return nil, err
 	}
@@ -78,7 +125,7 @@ func OnCarICEReceived(ice rtc.RequestICE, state *state.ServerState) ([]byte, err
 }
 
 // Register data channel creation and other handlers
-func OnCarSDPReturned(r *rtc.RTC, state *state.ServerState) {
+func OnCarSDPReturned(r *rtc.RTC, room *state.Room) {
 	log := r.Log()
 
 	// Register data channel creation
@@ -92,11 +139,11 @@ func OnCarSDPReturned(r *rtc.RTC, state *state.ServerState) {
 			switch d.Label() {
 			case livestreamconfig.ControlChannelLabel:
 				r.ControlChannel = d
-				registerCarControlMessage(d, state)
+				registerCarControlMessage(r, d, room)
 			case livestreamconfig.MetaChannelLabel:
-				registerCarMetaMessage(d, state)
+				registerCarMetaMessage(r, d, room)
 			case livestreamconfig.FrameChannelLabel:
-				registerCarFrameMessage(d, state)
+				registerCarFrameMessage(r, d, room)
 			default:
 				log.Warn().Str("label", d.Label()).Msg("Unknown car datachannel was opened for communication")
 			}
@@ -105,75 +152,159 @@ func OnCarSDPReturned(r *rtc.RTC, state *state.ServerState) {
 }
 
 // Used to debug connection state changes
-func onCarConnectionChange(car *rtc.RTC, state *state.ServerState) func(webrtc.PeerConnectionState) {
+func onCarConnectionChange(car *rtc.RTC, room *state.Room) func(webrtc.PeerConnectionState) {
 	log := car.Log()
 
 	return func(s webrtc.PeerConnectionState) {
 		log.Debug().Msgf("Car connection changed to new state %s", s.String())
 
-		// Create proto message
-		notification := pb_remote_config_messages.ConfigMessage{
-			Action: &pb_remote_config_messages.ConfigMessage_CarState_{
-				CarState: &pb_remote_config_messages.ConfigMessage_CarState{
-					Connected:       s == webrtc.PeerConnectionStateConnected,
-					TimestampOffset: car.TimestampOffset,
-				},
-			},
+		// Ignore connections that were already removed or replaced by a newer connection with the same id
+		if room.ConnectedCars.Get(car.Id) != car {
+			return
 		}
 
-		// Notify all clients of the new connection state
-		state.ConnectedPeers.ForEach(func(id string, r *rtc.RTC) {
-			if r.Id != car.Id {
-				err := r.SendMetaMessage(&notification)
-				if err != nil {
-					log.Err(err).Str("clientId", id).Msg("Could not notify connected client of connected car")
-				}
+		// Create proto message
+		notification := carStateNotification(car, s == webrtc.PeerConnectionStateConnected, room)
+
+		// Notify all clients that are routed to this car of the new connection state
+		routedClients := make([]*rtc.RTC, 0)
+		room.ForEachClientOfCar(car.Id, func(id string, r *rtc.RTC) {
+			routedClients = append(routedClients, r)
+			err := notifyPeer(r, notification, room)
+			if err != nil {
+				log.Err(err).Str("clientId", id).Msg("Could not notify connected client of connected car")
 			}
 		})
 
 		if s == webrtc.PeerConnectionStateConnected {
 			// handle connect
 		} else if s == webrtc.PeerConnectionStateDisconnected || s == webrtc.PeerConnectionStateClosed || s == webrtc.PeerConnectionStateFailed {
-			// disconnected, remove from list of connected peers
-			_ = state.ConnectedPeers.Remove(car.Id)
-			car.Destroy()
+			// Cars that negotiate over a WebSocket get a chance to recover with an ICE restart
+			if s == webrtc.PeerConnectionStateDisconnected && restartICE(car, room) {
+				return
+			}
+
+			// disconnected, remove from list of connected cars
+			removeCar(car, room)
+
+			rerouteClients(routedClients, room)
+		}
+	}
+}
+
+// Removes a car from the room and destroys its connection
+func removeCar(car *rtc.RTC, room *state.Room) {
+	room.RemoveCar(car)
+	room.RemoveGatherer(car.Id)
+	room.RemoveForwarder(car.Id)
+	room.RemoveCarStatus(car.Id)
+	room.RemoveResources(car.Id)
+	closeSignaling(car.Id, room)
+	car.Destroy()
+	room.RemoveIfEmpty()
+}
+
+// Makes room for a car (or replay) that registers with an id that is still in use. A car connection that is disconnected
+// (e.g. while it waits for an ICE restart) or closed is removed, an active one is kept and an error is returned.
+// RTCMap.Add deadlocks when it has to replace a connection itself, so this needs to happen before adding the new car
+func removeStaleCar(id string, room *state.Room) error {
+	existing := room.ConnectedCars.Get(id)
+	if existing == nil {
+		return nil
+	}
+	if existing.Pc == nil {
+		return fmt.Errorf("Car id '%s' is used by a replay", id)
+	}
+
+	s := existing.Pc.ConnectionState()
+	if s != webrtc.PeerConnectionStateDisconnected && s != webrtc.PeerConnectionStateClosed {
+		return fmt.Errorf("An active connection with id %s already exists", id)
+	}
+
+	log := existing.Log()
+	log.Info().Str("state", s.String()).Msg("Removing stale car connection, the car registered again")
+	removeCar(existing, room)
+	return nil
+}
+
+// Clients that were routed to a car that went away are now routed to another car (if any), let them know its state
+func rerouteClients(clients []*rtc.RTC, room *state.Room) {
+	for _, client := range clients {
+		updateClientTracks(client, room)
+
+		newCar := room.CarForClient(client.Id)
+		if newCar == nil {
+			continue
+		}
+		err := notifyPeer(client, carStateNotification(newCar, carIsConnected(newCar, room), room), room)
+		if err != nil {
+			log.Err(err).Str("clientId", client.Id).Msg("Could not notify connected client of rerouted car")
 		}
 	}
 }
 
+// Returns true if a car is connected. Synthetic cars (replays) do not have a connection, they are connected as long as they play
+func carIsConnected(car *rtc.RTC, room *state.Room) bool {
+	if car.Pc == nil {
+		return room.GetPlayer(car.Id) != nil
+	}
+	return car.IsConnected()
+}
+
+// Creates a car state message that can be sent to clients
+func carStateNotification(car *rtc.RTC, connected bool, room *state.Room) *pb_remote_config_messages.ConfigMessage {
+	return &pb_remote_config_messages.ConfigMessage{
+		Action: &pb_remote_config_messages.ConfigMessage_CarState_{
+			CarState: &pb_remote_config_messages.ConfigMessage_CarState{
+				Connected:       connected,
+				TimestampOffset: room.CarTimestampOffset(car),
+			},
+		},
+	}
+}
+
 //
 // Events based on data channel messages
 //
 
-func registerCarControlMessage(dc *webrtc.DataChannel, state *state.ServerState) {
+func registerCarControlMessage(car *rtc.RTC, dc *webrtc.DataChannel, room *state.Room) {
 	// Register text message handling
 	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
-		// act based on control message
+		recordMessage(recording.KindControl, car, "", msg, time.Now().UnixMilli(), room)
+
+		onCarControlMessage(car, msg.Data, room)
 	})
 }
 
-func registerCarMetaMessage(dc *webrtc.DataChannel, state *state.ServerState) {
+func registerCarMetaMessage(car *rtc.RTC, dc *webrtc.DataChannel, room *state.Room) {
+	car.MetaChannel = dc
+
 	// Register text message handling
 	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
-		// act based on control message
+		recordMessage(recording.KindMeta, car, "", msg, time.Now().UnixMilli(), room)
+
+		onCarMetaMessage(car, msg.Data, room)
 	})
 }
 
-func registerCarFrameMessage(dc *webrtc.DataChannel, state *state.ServerState) {
+func registerCarFrameMessage(car *rtc.RTC, dc *webrtc.DataChannel, room *state.Room) {
 	// Register text message handling
 	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
-		log.Debug().Int("length", len(msg.Data)).Msg("Forwarding car --> client frame data")
+		recordMessage(recording.KindFrame, car, "", msg, time.Now().UnixMilli(), room)
 
-		// Forward the message to all clients
-		state.ConnectedPeers.ForEach(func(id string, r *rtc.RTC) {
-			if id == livestreamconfig.CarId {
-				return
-			}
+		forwardCarFrame(car, msg.Data, room)
+	})
+}
 
-			err := r.SendFrameBytes(msg.Data)
-			if err != nil {
-				log.Err(err).Str("clientId", id).Msg("Could not forward frame data to client")
-			}
-		})
+// Forwards a frame of a car (live or replayed) to all clients that are routed to it
+func forwardCarFrame(car *rtc.RTC, data []byte, room *state.Room) {
+	log.Debug().Str("carId", car.Id).Int("length", len(data)).Msg("Forwarding car --> client frame data")
+
+	// Every client has its own queue, so that a slow client does not hold up the others
+	frame := fanout.NewFrame(data)
+	room.ForEachClientOfCar(car.Id, func(id string, r *rtc.RTC) {
+		if sender := room.GetSender(id); sender != nil {
+			sender.SendFrame(frame)
+		}
 	})
 }
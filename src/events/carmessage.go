@@ -0,0 +1,94 @@
+package events
+
+import (
+	"time"
+
+	"vu/ase/streamserver/src/state"
+
+	pb_remote_config_messages "github.com/VU-ASE/rovercom/packages/go"
+	rtc "github.com/VU-ASE/roverrtc/src"
+	"google.golang.org/protobuf/proto"
+)
+
+//
+// Actions based on messages of the car. Meta messages (ConfigMessages) update what the server knows about the car and are
+// relayed to every client that is subscribed to it. Control messages (e.g. acks of control data) only concern the active controller.
+//
+
+func onCarMetaMessage(car *rtc.RTC, data []byte, room *state.Room) {
+	log := car.Log()
+
+	parsedMsg := pb_remote_config_messages.ConfigMessage{}
+	if err := proto.Unmarshal(data, &parsedMsg); err != nil {
+		log.Err(err).Msg("Could not parse incoming car meta message")
+		return
+	}
+
+	now := time.Now().UnixMilli()
+	room.UpdateCarStatus(car.Id, func(status *state.CarStatus) {
+		status.LastMessageAt = now
+	})
+
+	// Messages this server does not know (e.g. from a newer car) are relayed as they are
+	switch parsedMsg.Action.(type) {
+	case *pb_remote_config_messages.ConfigMessage_CarState_:
+		carState := parsedMsg.GetCarState()
+
+		// A car can measure the offset between its clock and the server clock more precisely than the server can
+		if carState.TimestampOffset != 0 {
+			room.UpdateCarStatus(car.Id, func(status *state.CarStatus) {
+				status.TimestampOffset = carState.TimestampOffset
+			})
+		}
+		// Clients learn from the server whether the car is connected, the car cannot know how the server sees it
+		carState.Connected = carIsConnected(car, room)
+
+	case *pb_remote_config_messages.ConfigMessage_Error_:
+		message := parsedMsg.GetError().Message
+		log.Warn().Str("error", message).Msg("Car reported an error")
+
+		room.UpdateCarStatus(car.Id, func(status *state.CarStatus) {
+			status.LastError = message
+			status.LastErrorAt = now
+		})
+
+	case *pb_remote_config_messages.ConfigMessage_HumanControlRequest_, *pb_remote_config_messages.ConfigMessage_HumanControlState_:
+		// Only the server arbitrates human control
+		log.Warn().Msg("Dropped human control message from car")
+		return
+	}
+
+	log.Debug().Int("length", len(data)).Msg("Relaying car --> client meta message")
+	room.ForEachClientOfCar(car.Id, func(id string, r *rtc.RTC) {
+		if sender := room.GetSender(id); sender != nil {
+			sender.SendMessage(func() error {
+				return r.SendMetaMessage(&parsedMsg)
+			})
+		}
+	})
+}
+
+// Relays control messages of the car to the active controller, if it controls this car. Other clients did not send
+// the control data that the car responds to
+func onCarControlMessage(car *rtc.RTC, data []byte, room *state.Room) {
+	log := car.Log()
+
+	room.Lock.RLock()
+	controllerId := room.ActiveController
+	room.Lock.RUnlock()
+
+	if controllerId == "" || room.CarForClient(controllerId) != car {
+		log.Debug().Int("length", len(data)).Msg("Dropped car control message, nobody controls this car")
+		return
+	}
+	controller := room.ConnectedClients.Get(controllerId)
+	sender := room.GetSender(controllerId)
+	if controller == nil || sender == nil {
+		return
+	}
+
+	log.Debug().Str("clientId", controllerId).Int("length", len(data)).Msg("Relaying car --> controller control message")
+	sender.SendMessage(func() error {
+		return controller.SendControlBytes(data)
+	})
+}
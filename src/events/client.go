@@ -11,8 +11,12 @@ import (
 
 	pb_remote_config_messages "github.com/VU-ASE/rovercom/packages/go"
 
+	"vu/ase/streamserver/src/auth"
 	livestreamconfig "vu/ase/streamserver/src/config"
+	"vu/ase/streamserver/src/control"
+	"vu/ase/streamserver/src/messages"
 	"vu/ase/streamserver/src/peerconnection"
+	"vu/ase/streamserver/src/recording"
 	"vu/ase/streamserver/src/state"
 
 	rtc "github.com/VU-ASE/roverrtc/src"
@@ -21,43 +25,85 @@ import (
 )
 
 // Called when a client sends an offer to the HTTP server
-func OnClientSDPReceived(sdp rtc.RequestSDP, state *state.ServerState) ([]byte, error) {
-	// Create a new RTCPeerConnection
-	rtc, err := peerconnection.CreateFromOffer(sdp.Offer, sdp.Id, livestreamconfig.PeerConnectionConfig, state.RtcApi)
+func OnClientSDPReceived(sdp ClientRequestSDP, role auth.Role, room *state.Room) ([]byte, error) {
+	var gatherer *peerconnection.Gatherer
+	if sdp.Trickle {
+		gatherer = peerconnection.NewGatherer()
+	}
+
+	answer, err := connectClient(sdp, role, gatherer, room)
 	if err != nil {
 		return nil, err
 	}
 
-	log := rtc.Log()
+	return json.Marshal(answer)
+}
 
-	// Register connection state change handler
-	rtc.Pc.OnConnectionStateChange(onClientConnectionChange(rtc, state))
+// Creates the connection for a client offer and returns the answer, this is shared by all signaling methods.
+// If a gatherer is given, trickle ICE is used
+func connectClient(sdp ClientRequestSDP, role auth.Role, gatherer *peerconnection.Gatherer, room *state.Room) (*AnswerSDP, error) {
+	// The id chosen by the client is only used as a label, the server decides on the id of the session
+	sessionId, err := state.NewSessionId()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := state.NewSessionSecret()
+	if err != nil {
+		return nil, err
+	}
 
-	// Add rtc to list of client connections
-	err = state.ConnectedPeers.Add(sdp.Id, rtc, false)
+	// The subscription determines which media tracks are sent to the client
+	room.Subscribe(sessionId, sdp.CarIds)
+	tracks := room.TracksForClient(sessionId)
+	localTracks := make([]webrtc.TrackLocal, 0, len(tracks))
+	for _, track := range tracks {
+		localTracks = append(localTracks, track.Local)
+	}
+
+	// Create a new RTCPeerConnection
+	rtc, err := peerconnection.CreateFromOffer(sdp.Offer, sessionId, room.Server.PeerConnectionConfig(), room.Server.RtcApi, gatherer, localTracks)
 	if err != nil {
+		room.Unsubscribe(sessionId)
 		return nil, err
 	}
+	relayClientFeedback(rtc, tracks)
 
-	log.Info().Msg("Received SDP offer from client")
+	log := rtc.Log()
 
-	// Register data channel creation and other handlers
-	OnClientSDPReturned(rtc, state)
+	// Register connection state change handler
+	rtc.Pc.OnConnectionStateChange(onClientConnectionChange(rtc, room))
 
-	// Send answer back to client
-	payload, err := json.Marshal(rtc.Pc.LocalDescription())
+	// Add rtc to list of client connections
+	err = room.ConnectedClients.Add(sessionId, rtc, false)
 	if err != nil {
+		room.Unsubscribe(sessionId)
+		rtc.Destroy()
 		return nil, err
 	}
+	room.SetClientInfo(sessionId, state.ClientInfo{Role: role, Label: sdp.Id, Secret: secret})
+	room.SetSender(sessionId, newClientSender(rtc, room))
+	if gatherer != nil {
+		room.SetGatherer(sessionId, gatherer)
+	}
 
-	return payload, nil
+	log.Info().Str("roomId", room.Id).Str("label", sdp.Id).Str("role", string(role)).Msg("Received SDP offer from client")
+
+	// Register data channel creation and other handlers
+	OnClientSDPReturned(rtc, room)
+
+	// Send answer back to client, the client needs to use the session id and secret for all following requests
+	return &AnswerSDP{
+		SessionDescription: *rtc.Pc.LocalDescription(),
+		SessionId:          sessionId,
+		SessionSecret:      secret,
+	}, nil
 }
 
 // Called when a client sends an ICE candidate to the HTTP server
-func OnClientICEReceived(ice rtc.RequestICE, state *state.ServerState) ([]byte, error) {
-	// Get connection from list of connections
-	rtc := state.ConnectedPeers.Get(ice.Id)
-	if rtc == nil {
+func OnClientICEReceived(ice ClientRequestICE, room *state.Room) ([]byte, error) {
+	// Get connection from list of connections, only the client that created it may add candidates to it
+	rtc := room.ConnectedClients.Get(ice.Id)
+	if rtc == nil || !room.VerifySessionSecret(ice.Id, ice.Secret) {
 		return nil, fmt.Errorf("Client connection with id %s does not exist", ice.Id)
 	}
 
@@ -70,8 +116,12 @@ func OnClientICEReceived(ice rtc.RequestICE, state *state.ServerState) ([]byte,
 
 	log.Info().Msg("Received ICE candidates from client")
 
-	// Return all candidates to client
-	payload, err := json.Marshal(rtc.GetAllLocalCandidates())
+	// Return all candidates to client, unless it uses trickle ICE (then it fetches them from the candidates endpoint)
+	candidates := rtc.GetAllLocalCandidates()
+	if room.GetGatherer(rtc.Id) != nil {
+		candidates = []webrtc.ICECandidateInit{}
+	}
+	payload, err := json.Marshal(candidates)
 	if err != nil {
 		return nil, err
 	}
@@ -80,7 +130,7 @@ func OnClientICEReceived(ice rtc.RequestICE, state *state.ServerState) ([]byte,
 }
 
 // Create handlers for data channels
-func OnClientSDPReturned(r *rtc.RTC, state *state.ServerState) {
+func OnClientSDPReturned(r *rtc.RTC, room *state.Room) {
 	log := r.Log()
 
 	// Register data channel creation
@@ -93,11 +143,11 @@ func OnClientSDPReturned(r *rtc.RTC, state *state.ServerState) {
 
 			switch d.Label() {
 			case livestreamconfig.ControlChannelLabel:
-				registerClientControlMessage(r, d, state)
+				registerClientControlMessage(r, d, room)
 			case livestreamconfig.MetaChannelLabel:
-				registerClientMetaMessage(r, d, state)
+				registerClientMetaMessage(r, d, room)
 			case livestreamconfig.FrameChannelLabel:
-				registerClientFrameMessage(r, d, state)
+				registerClientFrameMessage(r, d, room)
 			default:
 				log.Warn().Str("label", d.Label()).Msg("Unknown client datachannel was opened for communication")
 			}
@@ -106,59 +156,63 @@ func OnClientSDPReturned(r *rtc.RTC, state *state.ServerState) {
 }
 
 // Used to debug connection state changes
-func onClientConnectionChange(client *rtc.RTC, state *state.ServerState) func(webrtc.PeerConnectionState) {
+func onClientConnectionChange(client *rtc.RTC, room *state.Room) func(webrtc.PeerConnectionState) {
 	log := client.Log()
 
 	return func(s webrtc.PeerConnectionState) {
 		log.Info().Str("newState", s.String()).Msg("Client connection changed to new state")
 
 		if s == webrtc.PeerConnectionStateDisconnected || s == webrtc.PeerConnectionStateClosed || s == webrtc.PeerConnectionStateFailed {
+			// Clients that negotiate over a WebSocket get a chance to recover with an ICE restart
+			if s == webrtc.PeerConnectionStateDisconnected && restartICE(client, room) {
+				return
+			}
+
 			// Remove the client from the list of connected clients
-			_ = state.ConnectedPeers.Remove(client.Id)
+			_ = room.ConnectedClients.Remove(client.Id)
+			room.Unsubscribe(client.Id)
+			room.RemoveClientInfo(client.Id)
+			if sender := room.RemoveSender(client.Id); sender != nil {
+				stats := sender.Stats()
+				log.Info().Uint64("sentFrames", stats.SentFrames).Uint64("droppedFrames", stats.DroppedFrames).Msg("Stopped sending frames to client")
+			}
+			room.RemoveGatherer(client.Id)
+			room.RemoveResources(client.Id)
+			closeSignaling(client.Id, room)
 			client.Destroy()
 
-			// If this client was the active controller, remove the active controller and let everyone know
-			state.Lock.RLock()
-			activeController := state.ActiveController
-			state.Lock.RUnlock()
-
-			if activeController == client.Id {
-				state.Lock.Lock()
-				state.ActiveController = ""
-				state.Lock.Unlock()
+			// A controller that is gone cannot stop the car anymore
+			onControllerGone(client.Id, "The active controller disconnected", room)
 
-				notification := pb_remote_config_messages.ConfigMessage{
-					Action: &pb_remote_config_messages.ConfigMessage_HumanControlState_{
-						HumanControlState: &pb_remote_config_messages.ConfigMessage_HumanControlState{
-							ActiveControllerId: "",
-						},
-					},
-				}
-
-				state.ConnectedPeers.ForEach(func(id string, r *rtc.RTC) {
-					err := r.SendMetaMessage(&notification)
-					if err != nil {
-						log.Err(err).Str("clientId", id).Msg("Could not notify connected client of human control release")
-					}
-				})
+			// If this client was the active controller, hand control to the next client in the queue and let everyone know
+			room.Lock.Lock()
+			if room.ActiveController == client.Id {
+				releaseControl(client.Id, "The active controller disconnected", room)
+			} else {
+				dequeueController(client.Id, room)
 			}
+			room.Lock.Unlock()
+
+			// Rooms are removed once everyone left
+			room.RemoveIfEmpty()
 		} else if s == webrtc.PeerConnectionStateConnected {
-			// Check if there already is a car connected, and send its car state if so
-			state.Lock.RLock()
-			car := state.ConnectedPeers.Get(livestreamconfig.CarId)
-			state.Lock.RUnlock()
+			// Check if there already is a car connected that this client is routed to, and send its car state if so
+			car := room.CarForClient(client.Id)
 			if car == nil {
 				return
 			}
 
+			// The client is a new viewer of the media tracks of its cars
+			requestKeyframes(client, room)
+
 			// Create proto message to notify client that a car is connected before they were connected
-			notification := pb_remote_config_messages.ConfigMessage{
-				Action: &pb_remote_config_messages.ConfigMessage_CarState_{
-					CarState: &pb_remote_config_messages.ConfigMessage_CarState{
-						Connected:       car.Pc.ConnectionState() == webrtc.PeerConnectionStateConnected,
-						TimestampOffset: car.TimestampOffset,
-					},
-				},
+			notification := carStateNotification(car, carIsConnected(car, room), room)
+
+			// Clients that negotiate over a WebSocket can be notified right away
+			if session := room.GetSignaling(client.Id); session != nil {
+				if err := session.Notify(notification); err != nil {
+					log.Err(err).Msg("Could not notify connected client of connected car over WebSocket")
+				}
 			}
 
 			// Sleep for 2 seconds to let the webcontroller set up the correct data channel handlers to process our message
@@ -167,7 +221,7 @@ func onClientConnectionChange(client *rtc.RTC, state *state.ServerState) func(we
 			log.Info().Msg("Notifying client of connected car")
 
 			// Notify the client of the car state
-			err := client.SendMetaMessage(&notification)
+			err := client.SendMetaMessage(notification)
 			if err != nil {
 				log.Err(err).Msg("Could not notify connected client of connected car")
 			}
@@ -179,11 +233,13 @@ func onClientConnectionChange(client *rtc.RTC, state *state.ServerState) func(we
 // Register data channel message handlers
 //
 
-func registerClientControlMessage(client *rtc.RTC, dc *webrtc.DataChannel, state *state.ServerState) {
+func registerClientControlMessage(client *rtc.RTC, dc *webrtc.DataChannel, room *state.Room) {
 	client.ControlChannel = dc
 
 	// Register text message handling
 	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		receivedAt := time.Now().UnixMilli()
+
 		//
 		// ...
 		// debug statements
@@ -191,16 +247,40 @@ func registerClientControlMessage(client *rtc.RTC, dc *webrtc.DataChannel, state
 		// ...
 		//
 
-		// Get the car connection
-		car := state.ConnectedPeers.Get(livestreamconfig.CarId)
+		// Viewers are not allowed to control the car
+		if !room.ClientRole(client.Id).CanControl() {
+			log.Warn().Str("clientId", client.Id).Msg("Dropped control data from client that is not allowed to control")
 
-		if car != nil {
-			log.Debug().Int("length", len(msg.Data)).Msg("Forwarding client --> car control data")
+			notification := pb_remote_config_messages.ConfigMessage{
+				Action: &pb_remote_config_messages.ConfigMessage_Error_{
+					Error: &pb_remote_config_messages.ConfigMessage_Error{
+						Message: "Cannot send control data: you are not allowed to control the car",
+					},
+				},
+			}
+			_ = client.SendMetaMessage(&notification)
+			return
+		}
+
+		// Get the connection of the car this client is routed to
+		car := room.CarForClient(client.Id)
 
+		if car != nil {
 			// Car is connexcted, try forwarding the control data
-			err := car.SendControlBytes(msg.Data)
-			if err != nil {
-				log.Err(err).Msg("Could not forward control data")
+			err := forwardControl(client, car, msg.Data, room)
+			if err == nil {
+				recordMessage(recording.KindControl, car, client.Id, msg, receivedAt, room)
+
+				// Control data of the active controller keeps its car from being stopped and renews its lease
+				feedWatchdog(client, car, room)
+				room.Lease.Renew(client.Id)
+			} else {
+				if err == ErrNotActiveController {
+					// Clients that wait for control, or whose lease or turn ended, do not drive the car
+					log.Warn().Str("clientId", client.Id).Msg("Dropped control data from client that is not the active controller")
+				} else {
+					log.Err(err).Msg("Could not forward control data")
+				}
 
 				// Report error to the client
 				notification := pb_remote_config_messages.ConfigMessage{
@@ -216,7 +296,7 @@ func registerClientControlMessage(client *rtc.RTC, dc *webrtc.DataChannel, state
 			// Car disconnected
 			log.Warn().Msg("Could not forward control data, car disconnected")
 
-			// Report to all clients that the car is not connected
+			// Report to the client that no car is connected
 			notification := pb_remote_config_messages.ConfigMessage{
 				Action: &pb_remote_config_messages.ConfigMessage_CarState_{
 					CarState: &pb_remote_config_messages.ConfigMessage_CarState{
@@ -225,19 +305,40 @@ func registerClientControlMessage(client *rtc.RTC, dc *webrtc.DataChannel, state
 				},
 			}
 
-			// Send this error to all properly configured clients (best-effort)
-			state.ConnectedPeers.ForEach(func(id string, r *rtc.RTC) {
-				_ = r.SendMetaMessage(&notification)
-			})
+			// Send this error to the client (best-effort)
+			_ = client.SendMetaMessage(&notification)
 		}
 	})
 }
 
-func registerClientMetaMessage(client *rtc.RTC, dc *webrtc.DataChannel, state *state.ServerState) {
+// Sends control data of a client to its car, if the client is the active controller. The room lock is held while sending,
+// so that control data cannot overtake the stop message that a car gets when its controller loses control
+func forwardControl(client *rtc.RTC, car *rtc.RTC, data []byte, room *state.Room) error {
+	room.Lock.RLock()
+	defer room.Lock.RUnlock()
+
+	if room.ActiveController != client.Id {
+		return ErrNotActiveController
+	}
+
+	log := client.Log()
+	log.Debug().Str("carId", car.Id).Int("length", len(data)).Msg("Forwarding client --> car control data")
+	return car.SendControlBytes(data)
+}
+
+func registerClientMetaMessage(client *rtc.RTC, dc *webrtc.DataChannel, room *state.Room) {
 	client.MetaChannel = dc
 
 	// Register text message handling
 	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		recordMessage(recording.KindMeta, room.CarForClient(client.Id), client.Id, msg, time.Now().UnixMilli(), room)
+
+		// Text messages are server messages, binary messages are ConfigMessages
+		if msg.IsString {
+			onClientServerMessage(client, msg.Data, room)
+			return
+		}
+
 		// Parse the meta message
 		parsedMsg := pb_remote_config_messages.ConfigMessage{}
 		err := proto.Unmarshal(msg.Data, &parsedMsg)
@@ -273,10 +374,10 @@ func registerClientMetaMessage(client *rtc.RTC, dc *webrtc.DataChannel, state *s
 			}
 			if request.Type == pb_remote_config_messages.ConfigMessage_HUMAN_CONTROL_RELEASE {
 				log.Debug().Msg("Received human control release request")
-				err = onClientRequestControlRelease(client, state)
+				err = onClientRequestControlRelease(client, room)
 			} else if request.Type == pb_remote_config_messages.ConfigMessage_HUMAN_CONTROL_TAKEOVER {
 				log.Debug().Msg("Received human control takeover request")
-				err = onClientRequestControlTakeover(client, state)
+				err = onClientRequestControlTakeover(client, room)
 			} else {
 				err = fmt.Errorf("Unknown human control request type")
 			}
@@ -293,12 +394,21 @@ func registerClientMetaMessage(client *rtc.RTC, dc *webrtc.DataChannel, state *s
 	})
 }
 
-func registerClientFrameMessage(client *rtc.RTC, dc *webrtc.DataChannel, state *state.ServerState) {
+func registerClientFrameMessage(client *rtc.RTC, dc *webrtc.DataChannel, room *state.Room) {
 	client.FrameChannel = dc
 
-	// Register text message handling
+	// The frame channel only carries frames to the client, clients change what they receive with streamOptions server messages
 	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
-		// act based on frame message
+		log := client.Log()
+		log.Warn().Int("length", len(msg.Data)).Msg("Dropped message from client on the frame channel")
+
+		err := messages.Send(client, &messages.ServerMessage{
+			Action:  messages.ActionError,
+			Message: fmt.Sprintf("Clients cannot send on the frame channel, use the %s server message to change the frames you receive", messages.ActionStreamOptions),
+		})
+		if err != nil {
+			log.Err(err).Msg("Could not report dropped frame channel message")
+		}
 	})
 }
 
@@ -306,14 +416,27 @@ func registerClientFrameMessage(client *rtc.RTC, dc *webrtc.DataChannel, state *
 // Actions based on meta messages by the client
 //
 
-func onClientRequestControlTakeover(client *rtc.RTC, state *state.ServerState) error {
-	state.Lock.Lock()
-	defer state.Lock.Unlock()
-
-	currentController := state.ConnectedPeers.Get(state.ActiveController)
-	if currentController != nil && currentController.IsConnected() && currentController.Id != client.Id {
-		err := fmt.Errorf("Cannot request control takeover: there is already an active controller")
+func onClientRequestControlTakeover(client *rtc.RTC, room *state.Room) error {
+	room.Lock.Lock()
+	defer room.Lock.Unlock()
+
+	var err error
+	var currentController *rtc.RTC
+	if !room.ClientRole(client.Id).CanControl() {
+		err = fmt.Errorf("Cannot request control takeover: you are not allowed to control the car")
+	} else {
+		var decision control.Decision
+		decision, currentController = arbitrate(client, room)
+		if decision == control.Enqueue {
+			// Wait in line until the active controller releases control (or its turn is over)
+			enqueueController(client, room)
+			return nil
+		} else if decision == control.Deny {
+			err = fmt.Errorf("Cannot request control takeover: another client controls the car")
+		}
+	}
 
+	if err != nil {
 		notification := pb_remote_config_messages.ConfigMessage{
 			Action: &pb_remote_config_messages.ConfigMessage_Error_{
 				Error: &pb_remote_config_messages.ConfigMessage_Error{
@@ -329,35 +452,33 @@ func onClientRequestControlTakeover(client *rtc.RTC, state *state.ServerState) e
 		return err
 	}
 
-	// update the active controller
-	// todo: make this a function
-	state.ActiveController = client.Id
-
-	notification := pb_remote_config_messages.ConfigMessage{
-		Action: &pb_remote_config_messages.ConfigMessage_HumanControlState_{
-			HumanControlState: &pb_remote_config_messages.ConfigMessage_HumanControlState{
-				ActiveControllerId: client.Id,
-			},
-		},
+	// The active controller loses control to a client with a higher priority
+	if currentController != nil && currentController.Id != client.Id {
+		takeControl(currentController.Id, "A client with a higher priority took over human control", room)
+		notifyControlRevoked(currentController.Id, "A client with a higher priority took over control", room)
 	}
 
-	state.ConnectedPeers.ForEach(func(id string, r *rtc.RTC) {
-		err := r.SendMetaMessage(&notification)
-		if err != nil {
-			log.Err(err).Msg("Could not broadcast controller state")
-		}
-	})
+	// A client that was waiting does not need to wait anymore
+	dequeueController(client.Id, room)
+	giveControl(client, room)
 
 	return nil
 }
 
-func onClientRequestControlRelease(client *rtc.RTC, state *state.ServerState) error {
-	state.Lock.Lock()
-	defer state.Lock.Unlock()
-
-	// Check if the client is the current controller
-	currentController := state.ActiveController
-	if currentController != client.Id {
+func onClientRequestControlRelease(client *rtc.RTC, room *state.Room) error {
+	room.Lock.Lock()
+	defer room.Lock.Unlock()
+
+	// Check if the client is the current controller, admins can force-release control from other clients
+	currentController := room.ActiveController
+	if currentController != client.Id && dequeueController(client.Id, room) {
+		// Clients that wait for control leave the queue by releasing control
+		log.Debug().Str("clientId", client.Id).Msg("Client left the human control queue")
+		return nil
+	} else if currentController != client.Id && room.ClientRole(client.Id).IsAdmin() {
+		// Admins releasing control for someone else revoke it, so the controller is notified and the action is audited
+		return revokeControl(client, currentController, "An admin released human control", room)
+	} else if currentController != client.Id {
 		err := fmt.Errorf("Cannot release control: you are not the active controller")
 
 		// Send this error to the client
@@ -377,25 +498,8 @@ func onClientRequestControlRelease(client *rtc.RTC, state *state.ServerState) er
 		return err
 	}
 
-	// Update the active controller
-	// todo: make this a function
-	state.ActiveController = ""
-
-	// Send a message to all clients that the controller has changed
-	notification := pb_remote_config_messages.ConfigMessage{
-		Action: &pb_remote_config_messages.ConfigMessage_HumanControlState_{
-			HumanControlState: &pb_remote_config_messages.ConfigMessage_HumanControlState{
-				ActiveControllerId: "",
-			},
-		},
-	}
-
-	state.ConnectedPeers.ForEach(func(id string, r *rtc.RTC) {
-		err := r.SendMetaMessage(&notification)
-		if err != nil {
-			log.Err(err).Msg("Could not broadcast controller state")
-		}
-	})
+	// Send a message to all clients that the controller has changed, control goes to the next client in the queue
+	releaseControl(currentController, "The active controller released control", room)
 
 	return nil
 }
@@ -0,0 +1,136 @@
+package events
+
+import (
+	"testing"
+	"time"
+
+	"vu/ase/streamserver/src/auth"
+	livestreamconfig "vu/ase/streamserver/src/config"
+	"vu/ase/streamserver/src/state"
+
+	rtc "github.com/VU-ASE/roverrtc/src"
+)
+
+// Creates a room with a car and the given controllers, which are all subscribed to the car. The connections do not have
+// peer connections or data channels, sending on them does nothing
+func newTestRoom(t *testing.T, config *livestreamconfig.Config, clientIds ...string) (*state.Room, *rtc.RTC, map[string]*rtc.RTC) {
+	t.Helper()
+
+	config.WebRTC.MuxUdpPorts = []int{0}
+	server, err := state.NewServerState(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room := server.DefaultRoom()
+
+	car := rtc.NewRTC("car")
+	if err := room.ConnectedCars.Add(car.Id, car, true); err != nil {
+		t.Fatal(err)
+	}
+
+	clients := make(map[string]*rtc.RTC)
+	for _, id := range clientIds {
+		client := rtc.NewRTC(id)
+		if err := room.ConnectedClients.Add(id, client, false); err != nil {
+			t.Fatal(err)
+		}
+		room.SetClientInfo(id, state.ClientInfo{Role: auth.RoleController})
+		room.Subscribe(id, []string{car.Id})
+		clients[id] = client
+	}
+	return room, car, clients
+}
+
+// Waits until the active controller of the room changed to the given id
+func waitForController(t *testing.T, room *state.Room, controllerId string) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		room.Lock.RLock()
+		current := room.ActiveController
+		room.Lock.RUnlock()
+		if current == controllerId {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Active controller did not change to %q", controllerId)
+}
+
+func TestQueuedClientCannotSendControl(t *testing.T) {
+	room, car, clients := newTestRoom(t, livestreamconfig.Default(), "first", "second")
+
+	room.Lock.Lock()
+	giveControl(clients["first"], room)
+	enqueueController(clients["second"], room)
+	room.Lock.Unlock()
+
+	if err := forwardControl(clients["first"], car, []byte{1}, room); err != nil {
+		t.Errorf("Active controller could not send control data: %v", err)
+	}
+	if err := forwardControl(clients["second"], car, []byte{1}, room); err != ErrNotActiveController {
+		t.Errorf("Queued client sending control data = %v, want %v", err, ErrNotActiveController)
+	}
+}
+
+func TestExpiredLeaseCannotSendControl(t *testing.T) {
+	config := livestreamconfig.Default()
+	config.Control.LeaseTTL = 50 * time.Millisecond
+	room, car, clients := newTestRoom(t, config, "first", "second")
+
+	room.Lock.Lock()
+	giveControl(clients["first"], room)
+	enqueueController(clients["second"], room)
+	room.Lock.Unlock()
+
+	// The lease is not renewed, so control goes to the next client in the queue
+	waitForController(t, room, "second")
+
+	if err := forwardControl(clients["first"], car, []byte{1}, room); err != ErrNotActiveController {
+		t.Errorf("Client with an expired lease sending control data = %v, want %v", err, ErrNotActiveController)
+	}
+	if err := forwardControl(clients["second"], car, []byte{1}, room); err != nil {
+		t.Errorf("Next controller could not send control data: %v", err)
+	}
+}
+
+func TestEndedTurnCannotSendControl(t *testing.T) {
+	config := livestreamconfig.Default()
+	config.Control.MaxTurn = 50 * time.Millisecond
+	room, car, clients := newTestRoom(t, config, "first", "second")
+
+	room.Lock.Lock()
+	giveControl(clients["first"], room)
+	enqueueController(clients["second"], room)
+	room.Lock.Unlock()
+
+	waitForController(t, room, "second")
+
+	if err := forwardControl(clients["first"], car, []byte{1}, room); err != ErrNotActiveController {
+		t.Errorf("Client whose turn ended sending control data = %v, want %v", err, ErrNotActiveController)
+	}
+	if err := forwardControl(clients["second"], car, []byte{1}, room); err != nil {
+		t.Errorf("Next controller could not send control data: %v", err)
+	}
+}
+
+func TestRevokedClientCannotSendControl(t *testing.T) {
+	room, car, clients := newTestRoom(t, livestreamconfig.Default(), "controller", "admin")
+	room.SetClientInfo("admin", state.ClientInfo{Role: auth.RoleAdmin})
+
+	room.Lock.Lock()
+	giveControl(clients["controller"], room)
+	err := revokeControl(clients["admin"], "controller", "Testing", room)
+	room.Lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody controls the car now, not even the admin that revoked control
+	for _, id := range []string{"controller", "admin"} {
+		if err := forwardControl(clients[id], car, []byte{1}, room); err != ErrNotActiveController {
+			t.Errorf("%s sending control data after revocation = %v, want %v", id, err, ErrNotActiveController)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package events
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"vu/ase/streamserver/src/fanout"
+	"vu/ase/streamserver/src/messages"
+	"vu/ase/streamserver/src/state"
+
+	rtc "github.com/VU-ASE/roverrtc/src"
+
+	"github.com/pion/webrtc/v4"
+)
+
+//
+// Every client receives frames from its own sender (see the fanout package), which lowers the frame rate of clients that cannot keep up.
+// Clients are told their frame rate, and cars are asked to lower theirs when none of their clients can keep up anyway.
+//
+
+// A car that was asked to lower its frame rate keeps that limit for at least this long, so that it does not speed up again
+// right after its clients caught up (at the lower rate)
+const minFrameRateLimit = 10 * time.Second
+
+// The connection of a client as seen by its sender
+type clientConnection struct {
+	client *rtc.RTC
+}
+
+func (c clientConnection) SendFrame(data []byte) error {
+	return c.client.SendFrameBytes(data)
+}
+
+func (c clientConnection) BufferedAmount() uint64 {
+	if c.client.FrameChannel == nil {
+		return 0
+	}
+	return c.client.FrameChannel.BufferedAmount()
+}
+
+func (c clientConnection) TransportStats() fanout.TransportStats {
+	if c.client.Pc == nil {
+		return fanout.TransportStats{}
+	}
+	for _, stats := range c.client.Pc.GetStats() {
+		if sctp, ok := stats.(webrtc.SCTPTransportStats); ok {
+			return fanout.TransportStats{
+				RoundTripTime:    time.Duration(sctp.SmoothedRoundTripTime * float64(time.Second)),
+				CongestionWindow: sctp.CongestionWindow,
+			}
+		}
+	}
+	return fanout.TransportStats{}
+}
+
+// Creates the sender that delivers frames and relayed car messages to a client, without waiting for other clients
+func newClientSender(client *rtc.RTC, room *state.Room) *fanout.Sender {
+	config := room.Server.Config.Stream
+	return fanout.NewSender(client.Id, config.FrameQueueSize, config.TargetLatency, clientConnection{client: client}, func(rate fanout.FrameRate) {
+		onClientFrameRate(client, rate, room)
+	})
+}
+
+// Called when the frame rate of a client changed because it could not keep up (or caught up)
+func onClientFrameRate(client *rtc.RTC, rate fanout.FrameRate, room *state.Room) {
+	log := client.Log()
+	log.Info().Float64("frameRate", rate.Effective).Float64("sourceFrameRate", rate.Source).Int64("latency", rate.Latency).Bool("constrained", rate.Constrained).Msg("Adapted frame rate of client")
+
+	err := messages.Send(client, &messages.ServerMessage{
+		Action:    messages.ActionFrameRate,
+		FrameRate: &rate,
+	})
+	if err != nil {
+		log.Err(err).Msg("Could not send frame rate")
+	}
+
+	for _, car := range room.SubscribedCars(client.Id) {
+		limitCarFrameRate(car, room)
+	}
+}
+
+// Called when a client changes what it receives, the options apply to the frames of this client only
+func onClientStreamOptions(client *rtc.RTC, changes *messages.StreamOptions, room *state.Room) error {
+	if changes == nil {
+		return fmt.Errorf("Cannot change stream options: no options were given")
+	}
+	sender := room.GetSender(client.Id)
+	if sender == nil {
+		return fmt.Errorf("Cannot change stream options: the client is not connected")
+	}
+
+	options := sender.Options()
+	if changes.MaxFrameRate != nil {
+		if *changes.MaxFrameRate < 0 {
+			return fmt.Errorf("Cannot change stream options: the maximum frame rate cannot be negative")
+		}
+		options.MaxFrameRate = *changes.MaxFrameRate
+	}
+	if changes.Paused != nil {
+		options.Paused = *changes.Paused
+	}
+	if changes.Quality != nil {
+		if !fanout.ValidQuality(*changes.Quality) {
+			return fmt.Errorf("Cannot change stream options: quality '%s' needs to be one of high, medium or low", *changes.Quality)
+		}
+		options.Quality = *changes.Quality
+	}
+	sender.SetOptions(options)
+
+	log := client.Log()
+	log.Info().Float64("maxFrameRate", options.MaxFrameRate).Bool("paused", options.Paused).Str("quality", options.Quality).Msg("Changed stream options of client")
+
+	// Cars might not need to send as many frames anymore, or need to send more again
+	for _, car := range room.SubscribedCars(client.Id) {
+		limitCarFrameRate(car, room)
+	}
+
+	return messages.Send(client, &messages.ServerMessage{
+		Action: messages.ActionStreamOptions,
+		Stream: &messages.StreamOptions{
+			MaxFrameRate: &options.MaxFrameRate,
+			Paused:       &options.Paused,
+			Quality:      &options.Quality,
+		},
+	})
+}
+
+// Asks a car to send no more frames than its fastest client can receive if none of its clients keep up, and lifts that limit otherwise.
+// Clients that asked for fewer frames count as clients that cannot keep up (even if their frame rate is not adapted), paused clients
+// do not count at all. Only cars that opted in to server messages are asked, other cars keep sending every frame
+func limitCarFrameRate(car *rtc.RTC, room *state.Room) {
+	// Synthetic cars cannot be asked anything, and cars that went away do not need to be
+	if car.Pc == nil || room.ConnectedCars.Get(car.Id) != car || !room.GetCarStatus(car.Id).ServerMessages {
+		return
+	}
+
+	clients := 0
+	constrained := 0
+	maxFrameRate := 0.0
+	room.ForEachClientOfCar(car.Id, func(id string, r *rtc.RTC) {
+		sender := room.GetSender(id)
+		if sender == nil {
+			return
+		}
+		stats := sender.Stats()
+		if stats.Options.Paused {
+			return
+		}
+		clients++
+
+		// The frames a client can or wants to receive, 0 if it does not limit them
+		wanted := 0.0
+		if stats.FrameRate.Constrained {
+			wanted = stats.FrameRate.Effective
+		}
+		if limit := stats.Options.MaxFrameRate; limit > 0 && (wanted == 0 || limit < wanted) {
+			wanted = limit
+		}
+		if wanted > 0 {
+			constrained++
+			maxFrameRate = max(maxFrameRate, wanted)
+		}
+	})
+	if clients == 0 || constrained < clients {
+		maxFrameRate = 0
+	}
+	if maxFrameRate > 0 {
+		maxFrameRate = max(1, math.Round(maxFrameRate))
+	}
+
+	now := time.Now().UnixMilli()
+	previous := room.GetCarStatus(car.Id)
+	if maxFrameRate == previous.MaxFrameRate {
+		return
+	}
+	if remaining := minFrameRateLimit - time.Duration(now-previous.MaxFrameRateAt)*time.Millisecond; maxFrameRate == 0 && remaining > 0 {
+		// Check again once the limit may be lifted, the clients might not change their frame rate anymore until then.
+		// Every car has a single timer for this, which is moved to the end of the current limit
+		room.UpdateCarStatus(car.Id, func(status *state.CarStatus) {
+			if status.LiftTimer == nil {
+				status.LiftTimer = time.AfterFunc(remaining, func() {
+					limitCarFrameRate(car, room)
+				})
+			} else {
+				status.LiftTimer.Reset(remaining)
+			}
+		})
+		return
+	}
+	room.UpdateCarStatus(car.Id, func(status *state.CarStatus) {
+		status.MaxFrameRate = maxFrameRate
+		status.MaxFrameRateAt = now
+	})
+
+	log := car.Log()
+	log.Info().Float64("maxFrameRate", maxFrameRate).Int("clients", clients).Msg("Asking car to adapt its frame rate")
+
+	err := messages.Send(car, &messages.ServerMessage{
+		Action:       messages.ActionMaxFrameRate,
+		CarIds:       []string{car.Id},
+		MaxFrameRate: &maxFrameRate,
+	})
+	if err != nil {
+		log.Err(err).Msg("Could not send maximum frame rate to car")
+	}
+}
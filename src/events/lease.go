@@ -0,0 +1,105 @@
+package events
+
+import (
+	"fmt"
+
+	"vu/ase/streamserver/src/messages"
+	"vu/ase/streamserver/src/state"
+
+	pb_remote_config_messages "github.com/VU-ASE/rovercom/packages/go"
+	rtc "github.com/VU-ASE/roverrtc/src"
+)
+
+//
+// The active controller holds control as a lease (see the control package). Control data renews the lease implicitly,
+// controllers that are idle (e.g. waiting at a standstill) renew it with heartbeat server messages.
+//
+
+// Returned when a client sends control data while it does not hold control (anymore)
+var ErrNotActiveController = fmt.Errorf("Cannot send control data: you are not the active controller")
+
+// Gives the lease to a client that took over control and lets every client know how long it lasts, the caller needs to hold the room lock
+func grantLease(client *rtc.RTC, room *state.Room) {
+	room.Lease.Grant(client.Id, func(controllerId string) {
+		onLeaseExpired(controllerId, room)
+	})
+
+	log := client.Log()
+	lease := room.Lease.State()
+	room.ConnectedClients.ForEach(func(id string, r *rtc.RTC) {
+		err := messages.Send(r, &messages.ServerMessage{
+			Action: messages.ActionLease,
+			Lease:  &lease,
+		})
+		if err != nil {
+			log.Err(err).Str("clientId", id).Msg("Could not send control lease")
+		}
+	})
+}
+
+// Called when the active controller did not renew its lease in time, control is released for it
+func onLeaseExpired(controllerId string, room *state.Room) {
+	room.Lock.Lock()
+	defer room.Lock.Unlock()
+
+	if room.ActiveController != controllerId {
+		return
+	}
+
+	log := room.Log()
+	log.Info().Str("controllerId", controllerId).Msg("Control lease expired, released human control")
+
+	releaseControl(controllerId, "The control lease of the active controller expired", room)
+}
+
+// Called when a client renews its lease without sending control data, the remaining lease time is sent back
+func onClientHeartbeat(client *rtc.RTC, room *state.Room) error {
+	if !room.Lease.Renew(client.Id) {
+		return fmt.Errorf("Cannot renew lease: you are not the active controller")
+	}
+
+	lease := room.Lease.State()
+	return messages.Send(client, &messages.ServerMessage{
+		Action: messages.ActionLease,
+		Lease:  &lease,
+	})
+}
+
+// Lets every client in the room know who controls the car now, an empty id means that nobody does.
+// Cars that drive themselves are told as well, so that they know when to follow the control data of the controller
+func broadcastControlState(controllerId string, room *state.Room) {
+	log := room.Log()
+
+	notification := controlStateNotification(controllerId)
+	room.ConnectedClients.ForEach(func(id string, r *rtc.RTC) {
+		err := notifyPeer(r, notification, room)
+		if err != nil {
+			log.Err(err).Str("clientId", id).Msg("Could not broadcast controller state")
+		}
+	})
+
+	if !room.Server.Policy.Autonomous() {
+		return
+	}
+	room.ConnectedCars.ForEach(func(id string, r *rtc.RTC) {
+		// Synthetic cars do not drive
+		if r.Pc == nil {
+			return
+		}
+		err := notifyPeer(r, notification, room)
+		if err != nil {
+			log.Err(err).Str("carId", id).Msg("Could not broadcast controller state to car")
+		}
+	})
+}
+
+// Create proto message that tells who controls the car now
+func controlStateNotification(controllerId string) *pb_remote_config_messages.ConfigMessage {
+	return &pb_remote_config_messages.ConfigMessage{
+		Action: &pb_remote_config_messages.ConfigMessage_HumanControlState_{
+			HumanControlState: &pb_remote_config_messages.ConfigMessage_HumanControlState{
+				ActiveControllerId: controllerId,
+			},
+		},
+	}
+}
@@ -0,0 +1,175 @@
+package events
+
+import (
+	"vu/ase/streamserver/src/media"
+	"vu/ase/streamserver/src/messages"
+	"vu/ase/streamserver/src/state"
+
+	rtc "github.com/VU-ASE/roverrtc/src"
+
+	"github.com/pion/webrtc/v4"
+)
+
+//
+// Media tracks that cars publish are forwarded to the clients that are subscribed to them (see the media package).
+// Clients receive the tracks that are available when they connect, as far as their offer has room for them (e.g. recvonly video transceivers).
+// Adding or removing tracks later on requires renegotiation, so only clients that negotiate over a WebSocket follow changes in their tracks.
+// Other clients (HTTP signaling and WHEP) are told over the meta channel that their tracks changed, they need to send a new offer to receive them.
+//
+
+// Called when a car starts publishing a media track
+func onCarTrack(car *rtc.RTC, forwarder *media.Forwarder, room *state.Room) func(*webrtc.TrackRemote, *webrtc.RTPReceiver) {
+	log := car.Log()
+
+	// The connection of the car is cleared when it is destroyed, but the track can still request keyframes until then
+	pc := car.Pc
+
+	return func(remote *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		_, err := forwarder.AddTrack(remote, pc, func(*media.Track) {
+			updateTracksOfClients(car.Id, room)
+		})
+		if err != nil {
+			log.Err(err).Str("trackId", remote.ID()).Msg("Could not forward media track")
+			return
+		}
+
+		updateTracksOfClients(car.Id, room)
+	}
+}
+
+// Relays the keyframe requests of a client for the tracks it was given when it connected
+func relayClientFeedback(client *rtc.RTC, tracks []*media.Track) {
+	for _, sender := range client.Pc.GetSenders() {
+		for _, track := range tracks {
+			if sender.Track() == track.Local {
+				go track.RelayFeedback(sender)
+			}
+		}
+	}
+}
+
+// Asks the cars of a client for keyframes, so that a client that just connected does not have to wait for the next one
+func requestKeyframes(client *rtc.RTC, room *state.Room) {
+	log := client.Log()
+
+	for _, track := range room.TracksForClient(client.Id) {
+		if err := track.RequestKeyframe(); err != nil {
+			log.Err(err).Str("trackId", track.Local.ID()).Msg("Could not request keyframe for new viewer")
+		}
+	}
+}
+
+// Updates the tracks of all clients that are subscribed to a car
+func updateTracksOfClients(carId string, room *state.Room) {
+	// Renegotiation waits for the signaling session of the client, which should not happen while the list of clients is locked
+	clients := make([]*rtc.RTC, 0)
+	room.ForEachClientOfCar(carId, func(id string, client *rtc.RTC) {
+		clients = append(clients, client)
+	})
+
+	for _, client := range clients {
+		updateClientTracks(client, room)
+	}
+}
+
+// Makes the tracks a client receives match the cars it is subscribed to, and renegotiates the connection if they changed.
+// Clients that do not negotiate over a WebSocket cannot be renegotiated, they are notified instead
+func updateClientTracks(client *rtc.RTC, room *state.Room) {
+	session := room.GetSignaling(client.Id)
+	if session == nil {
+		notifyTracksChanged(client, room)
+		return
+	}
+
+	session.Negotiation.Lock()
+	defer session.Negotiation.Unlock()
+
+	if client.Pc == nil {
+		return
+	}
+
+	log := client.Log()
+
+	added, removed := diffClientTracks(client, room)
+	changed := false
+	for _, sender := range removed {
+		trackId := sender.Track().ID()
+		if err := client.Pc.RemoveTrack(sender); err != nil {
+			log.Err(err).Str("trackId", trackId).Msg("Could not remove media track")
+			continue
+		}
+		changed = true
+	}
+
+	for _, track := range added {
+		sender, err := client.Pc.AddTrack(track.Local)
+		if err != nil {
+			log.Err(err).Str("trackId", track.Local.ID()).Msg("Could not add media track")
+			continue
+		}
+		go track.RelayFeedback(sender)
+		changed = true
+	}
+
+	if !changed {
+		return
+	}
+
+	if err := renegotiate(client, false, session); err != nil {
+		log.Err(err).Msg("Could not renegotiate media tracks")
+	}
+}
+
+// Lets a client that cannot be renegotiated know that the tracks of its cars no longer match the tracks it receives
+func notifyTracksChanged(client *rtc.RTC, room *state.Room) {
+	if client.Pc == nil {
+		return
+	}
+
+	added, removed := diffClientTracks(client, room)
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+
+	carIds := make([]string, 0)
+	for _, car := range room.SubscribedCars(client.Id) {
+		carIds = append(carIds, car.Id)
+	}
+	err := messages.Send(client, &messages.ServerMessage{
+		Action:  messages.ActionTracksChanged,
+		CarIds:  carIds,
+		Message: "The media tracks of your cars changed, send a new offer (or use WebSocket signaling) to receive them",
+	})
+	if err != nil {
+		log := client.Log()
+		log.Err(err).Msg("Could not notify client of changed media tracks")
+	}
+}
+
+// Compares the tracks a client receives with the tracks of the cars it is subscribed to. Returns the tracks that the client
+// does not receive yet, and the senders of the tracks that it should no longer receive
+func diffClientTracks(client *rtc.RTC, room *state.Room) ([]*media.Track, []*webrtc.RTPSender) {
+	wanted := make(map[webrtc.TrackLocal]*media.Track)
+	for _, track := range room.TracksForClient(client.Id) {
+		wanted[track.Local] = track
+	}
+
+	removed := make([]*webrtc.RTPSender, 0)
+	for _, sender := range client.Pc.GetSenders() {
+		local := sender.Track()
+		if local == nil {
+			continue
+		}
+		if _, ok := wanted[local]; ok {
+			delete(wanted, local)
+			continue
+		}
+		removed = append(removed, sender)
+	}
+
+	added := make([]*media.Track, 0, len(wanted))
+	for _, track := range wanted {
+		added = append(added, track)
+	}
+	return added, removed
+}
@@ -0,0 +1,150 @@
+package events
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"vu/ase/streamserver/src/auth"
+	livestreamconfig "vu/ase/streamserver/src/config"
+	"vu/ase/streamserver/src/messages"
+	"vu/ase/streamserver/src/state"
+
+	rtc "github.com/VU-ASE/roverrtc/src"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+// Creates a peer connection for a test car or client, which connects to the server over the loopback interface
+func newTestPeerConnection(t *testing.T) *webrtc.PeerConnection {
+	t.Helper()
+
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	s := webrtc.SettingEngine{}
+	s.SetIncludeLoopbackCandidate(true)
+	pc, err := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithSettingEngine(s)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	return pc
+}
+
+// Sends the offer of a peer connection (with all of its candidates) to the server with signal, and applies the answer
+func negotiate(t *testing.T, pc *webrtc.PeerConnection, signal func(offer webrtc.SessionDescription) ([]byte, error)) {
+	t.Helper()
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gatherComplete
+
+	payload, err := signal(*pc.LocalDescription())
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer := AnswerSDP{}
+	if err := json.Unmarshal(payload, &answer); err != nil {
+		t.Fatal(err)
+	}
+	if err := pc.SetRemoteDescription(answer.SessionDescription); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTrackAfterClientConnected(t *testing.T) {
+	config := livestreamconfig.Default()
+	config.WebRTC.MuxUdpPorts = []int{0}
+	config.WebRTC.NatIps = []string{"127.0.0.1"}
+	server, err := state.NewServerState(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Destroy)
+	room := server.DefaultRoom()
+
+	// The car offers a video track, but only publishes it (sends packets) once the client is connected
+	car := newTestPeerConnection(t)
+	video, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "camera", "car")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := car.AddTrack(video); err != nil {
+		t.Fatal(err)
+	}
+	negotiate(t, car, func(offer webrtc.SessionDescription) ([]byte, error) {
+		request := CarRequestSDP{RequestSDP: rtc.RequestSDP{Offer: offer, Id: "car", Timestamp: time.Now().UnixMilli()}}
+		return OnCarSDPReceived(request, time.Now().UnixMilli(), room)
+	})
+
+	// The client signals over HTTP, so the server cannot renegotiate its connection
+	client := newTestPeerConnection(t)
+	if _, err := client.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := client.CreateDataChannel(livestreamconfig.MetaChannelLabel, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened := make(chan struct{})
+	meta.OnOpen(func() { close(opened) })
+	received := make(chan *messages.ServerMessage, 16)
+	meta.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if msg.IsString {
+			if parsed, err := messages.Parse(msg.Data); err == nil {
+				received <- parsed
+			}
+		}
+	})
+	negotiate(t, client, func(offer webrtc.SessionDescription) ([]byte, error) {
+		request := ClientRequestSDP{RequestSDP: rtc.RequestSDP{Offer: offer, Id: "viewer"}, CarIds: []string{"car"}}
+		return OnClientSDPReceived(request, auth.RoleViewer, room)
+	})
+
+	select {
+	case <-opened:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Meta channel of the client did not open")
+	}
+
+	// Publish the track, the client needs to be told that it has to send a new offer to receive it
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_ = video.WriteSample(media.Sample{Data: []byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a}, Duration: 20 * time.Millisecond})
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	deadline := time.After(10 * time.Second)
+	for {
+		select {
+		case msg := <-received:
+			if msg.Action != messages.ActionTracksChanged {
+				continue
+			}
+			if len(msg.CarIds) != 1 || msg.CarIds[0] != "car" {
+				t.Errorf("Client was told that the tracks of cars %v changed, want [car]", msg.CarIds)
+			}
+			return
+		case <-deadline:
+			t.Fatal("Client was not told that the car published a new track")
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package events
+
+import (
+	"fmt"
+
+	"vu/ase/streamserver/src/control"
+	"vu/ase/streamserver/src/messages"
+	"vu/ase/streamserver/src/state"
+
+	rtc "github.com/VU-ASE/roverrtc/src"
+)
+
+//
+// Admins (e.g. instructors) can override the regular control arbitration: they can take over control from whoever holds it,
+// and take control away from a client (or remove it from the queue). The client that loses control is told so explicitly,
+// and every override is kept in the audit log of the room.
+//
+
+// Called when an admin takes over control, the active controller (if any) loses control without waiting for its turn to end
+func onClientForceTakeover(client *rtc.RTC, reason string, room *state.Room) error {
+	if !room.ClientRole(client.Id).IsAdmin() {
+		return ErrNotAdmin
+	}
+
+	room.Lock.Lock()
+	defer room.Lock.Unlock()
+
+	previousController := room.ActiveController
+	if previousController == client.Id {
+		return fmt.Errorf("Cannot take over control: you are already the active controller")
+	}
+
+	if previousController != "" {
+		takeControl(previousController, "An admin took over human control", room)
+		notifyControlRevoked(previousController, reason, room)
+	}
+
+	// The admin might have been waiting in line as well
+	dequeueController(client.Id, room)
+	giveControl(client, room)
+
+	audit(control.AuditEntry{
+		Action:       control.AuditForceTakeover,
+		AdminId:      client.Id,
+		ControllerId: previousController,
+		Reason:       reason,
+	}, room)
+	return nil
+}
+
+// Called when an admin takes control away from a client
+func onClientRevokeControl(client *rtc.RTC, controllerId string, reason string, room *state.Room) error {
+	if !room.ClientRole(client.Id).IsAdmin() {
+		return ErrNotAdmin
+	}
+	if controllerId == "" {
+		return fmt.Errorf("Cannot revoke control: no controller id was given")
+	}
+
+	room.Lock.Lock()
+	defer room.Lock.Unlock()
+
+	return revokeControl(client, controllerId, reason, room)
+}
+
+// Takes control away from a client, or removes it from the queue. Control goes to the next client in the queue,
+// the caller needs to hold the room lock
+func revokeControl(admin *rtc.RTC, controllerId string, reason string, room *state.Room) error {
+	if room.ActiveController == controllerId {
+		releaseControl(controllerId, "An admin revoked human control", room)
+	} else if !dequeueController(controllerId, room) {
+		return fmt.Errorf("Cannot revoke control: client %s does not control the car and is not waiting for control", controllerId)
+	}
+
+	notifyControlRevoked(controllerId, reason, room)
+	audit(control.AuditEntry{
+		Action:       control.AuditRevoke,
+		AdminId:      admin.Id,
+		ControllerId: controllerId,
+		Reason:       reason,
+	}, room)
+	return nil
+}
+
+// Sends the audit log of the room to an admin
+func onClientListAudit(client *rtc.RTC, room *state.Room) error {
+	if !room.ClientRole(client.Id).IsAdmin() {
+		return ErrNotAdmin
+	}
+
+	return messages.Send(client, &messages.ServerMessage{
+		Action: messages.ActionAudit,
+		Audit:  room.Audit.Entries(),
+	})
+}
+
+// Lets a client know that control was taken away from it (by an admin, or by a client with a higher priority).
+// The control data it sends from now on is dropped instead of forwarded to the car
+func notifyControlRevoked(controllerId string, reason string, room *state.Room) {
+	client := room.ConnectedClients.Get(controllerId)
+	if client == nil {
+		return
+	}
+
+	err := messages.Send(client, &messages.ServerMessage{
+		Action:       messages.ActionControlRevoked,
+		ControllerId: controllerId,
+		Message:      reason,
+	})
+	if err != nil {
+		log := client.Log()
+		log.Err(err).Msg("Could not notify client of revoked control")
+	}
+}
+
+// Adds an entry to the audit log of the room, and logs it
+func audit(entry control.AuditEntry, room *state.Room) {
+	entry = room.Audit.Add(entry)
+
+	log := room.Log()
+	log.Info().
+		Str("context", "audit").
+		Str("action", entry.Action).
+		Str("adminId", entry.AdminId).
+		Str("controllerId", entry.ControllerId).
+		Str("reason", entry.Reason).
+		Msg("Admin overrode human control")
+}
@@ -0,0 +1,38 @@
+package events
+
+import (
+	"vu/ase/streamserver/src/control"
+	"vu/ase/streamserver/src/state"
+
+	rtc "github.com/VU-ASE/roverrtc/src"
+)
+
+//
+// The control policy of the server (see the control package) decides on takeover requests, the events in this package
+// carry out its decisions.
+//
+
+// Asks the control policy what happens to the takeover request of a client, the caller needs to hold the room lock.
+// Also returns the active controller if it is still connected, a controller that is gone does not hold control anymore
+func arbitrate(client *rtc.RTC, room *state.Room) (control.Decision, *rtc.RTC) {
+	requester := contender(client.Id, room)
+
+	holder := room.ConnectedClients.Get(room.ActiveController)
+	if holder == nil || !holder.IsConnected() {
+		return room.Server.Policy.Decide(requester, nil), nil
+	}
+
+	current := contender(holder.Id, room)
+	decision := room.Server.Policy.Decide(requester, &current)
+
+	log := client.Log()
+	log.Debug().Str("policy", room.Server.Policy.Name()).Str("controllerId", holder.Id).Str("decision", decision.String()).Msg("Arbitrated human control request")
+	return decision, holder
+}
+
+func contender(clientId string, room *state.Room) control.Contender {
+	return control.Contender{
+		Id:       clientId,
+		Priority: room.ClientRole(clientId).ControlPriority(),
+	}
+}
@@ -0,0 +1,120 @@
+package events
+
+import (
+	"vu/ase/streamserver/src/messages"
+	"vu/ase/streamserver/src/state"
+
+	rtc "github.com/VU-ASE/roverrtc/src"
+)
+
+//
+// Clients that request control while someone else holds it are queued (see the control package). Whenever control is released,
+// it goes to the next client in line. With a maximum turn length, the active controller has to make way when its turn is over.
+//
+
+// Gives control to a client, the caller needs to hold the room lock
+func giveControl(client *rtc.RTC, room *state.Room) {
+	// update the active controller
+	room.ActiveController = client.Id
+
+	broadcastControlState(client.Id, room)
+
+	// Control lasts as long as the client keeps renewing its lease, and its turn is not over
+	grantLease(client, room)
+	room.Queue.StartTurn(client.Id, func(controllerId string) {
+		onTurnOver(controllerId, room)
+	})
+}
+
+// Takes control away from the active controller and hands it to the next client in the queue, the caller needs to hold the room lock
+func releaseControl(controllerId string, reason string, room *state.Room) {
+	takeControl(controllerId, reason, room)
+
+	if !handOverControl(room) {
+		broadcastControlState("", room)
+	}
+}
+
+// Takes control away from the active controller without handing it to anyone, the caller needs to hold the room lock
+func takeControl(controllerId string, reason string, room *state.Room) {
+	// Nobody controls the car from now on
+	onControllerGone(controllerId, reason, room)
+
+	room.ActiveController = ""
+	room.Lease.Revoke(controllerId)
+	room.Queue.EndTurn(controllerId)
+}
+
+// Gives control to the next client in the queue that is still allowed to control, the caller needs to hold the room lock.
+// Returns false if nobody was waiting
+func handOverControl(room *state.Room) bool {
+	defer broadcastQueue(room)
+
+	for {
+		next, ok := room.Queue.Next()
+		if !ok {
+			return false
+		}
+
+		client := room.ConnectedClients.Get(next)
+		if client == nil || !room.ClientRole(next).CanControl() {
+			continue
+		}
+
+		log := client.Log()
+		log.Info().Msg("Handing human control to the next client in the queue")
+		giveControl(client, room)
+		return true
+	}
+}
+
+// Called when a client requests control while another client holds it
+func enqueueController(client *rtc.RTC, room *state.Room) {
+	position := room.Queue.Enqueue(client.Id)
+
+	log := client.Log()
+	log.Info().Int("position", position).Msg("Client is waiting for human control")
+
+	// The active controller might have had its turn already while nobody was waiting
+	if room.Queue.TurnOver(room.ActiveController) {
+		releaseControl(room.ActiveController, "The turn of the active controller ended", room)
+		return
+	}
+	broadcastQueue(room)
+}
+
+// Called when the turn of the active controller is over, control only changes hands if someone is waiting
+func onTurnOver(controllerId string, room *state.Room) {
+	room.Lock.Lock()
+	defer room.Lock.Unlock()
+
+	if room.ActiveController != controllerId || room.Queue.Empty() {
+		return
+	}
+	releaseControl(controllerId, "The turn of the active controller ended", room)
+}
+
+// Called when a client that waits for control does not want to wait anymore (or disconnected)
+func dequeueController(clientId string, room *state.Room) bool {
+	if !room.Queue.Remove(clientId) {
+		return false
+	}
+	broadcastQueue(room)
+	return true
+}
+
+// Lets every client in the room know who is waiting for control, and where it is in line
+func broadcastQueue(room *state.Room) {
+	log := room.Log()
+
+	room.ConnectedClients.ForEach(func(id string, r *rtc.RTC) {
+		queue := room.Queue.State(id)
+		err := messages.Send(r, &messages.ServerMessage{
+			Action: messages.ActionQueue,
+			Queue:  &queue,
+		})
+		if err != nil {
+			log.Err(err).Str("clientId", id).Msg("Could not send control queue")
+		}
+	})
+}
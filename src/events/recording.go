@@ -0,0 +1,94 @@
+package events
+
+import (
+	"fmt"
+
+	"vu/ase/streamserver/src/messages"
+	"vu/ase/streamserver/src/recording"
+	"vu/ase/streamserver/src/state"
+
+	rtc "github.com/VU-ASE/roverrtc/src"
+
+	"github.com/pion/webrtc/v4"
+)
+
+//
+// Recordings are started and stopped by admins, either through the HTTP endpoints or with server messages on the meta channel.
+// While a room is being recorded, every frame, control message and meta message that passes through it is written to the recording.
+//
+
+// Returned when a client that is not an admin tries to manage recordings or override control
+var ErrNotAdmin = fmt.Errorf("Only admins can do this")
+
+// Adds a data channel message to the recording of the room (if any). The car determines the timestamp offset of the record,
+// the client id is empty for messages of the car
+func recordMessage(kind string, car *rtc.RTC, clientId string, msg webrtc.DataChannelMessage, receivedAt int64, room *state.Room) {
+	if !room.IsRecording() {
+		return
+	}
+
+	record := recording.Record{
+		Kind:       kind,
+		Timestamp:  receivedAt,
+		ReceivedAt: receivedAt,
+		ClientId:   clientId,
+		Text:       msg.IsString,
+		Data:       msg.Data,
+	}
+	if car != nil {
+		record.CarId = car.Id
+		record.Timestamp += room.CarTimestampOffset(car)
+	}
+	room.Record(record)
+}
+
+// Starts recording a room on request of an admin
+func OnRecordingStart(room *state.Room) (*recording.Info, error) {
+	recorder, err := room.StartRecording()
+	if err != nil {
+		return nil, err
+	}
+
+	info := recorder.Info()
+	return &info, nil
+}
+
+// Stops recording a room on request of an admin
+func OnRecordingStop(room *state.Room) (*recording.Info, error) {
+	recorder, err := room.StopRecording()
+	if err != nil {
+		return nil, err
+	}
+	room.RemoveIfEmpty()
+
+	info := recorder.Info()
+	return &info, nil
+}
+
+// Returns all recordings of a room, newest first
+func OnRecordingsRequested(room *state.Room) ([]recording.Info, error) {
+	return recording.List(room.RecordingDirectory(), room.ActiveRecording())
+}
+
+// Called when a client starts or stops the recording with a server message
+func onClientRecordingMessage(client *rtc.RTC, start bool, room *state.Room) error {
+	if !room.ClientRole(client.Id).IsAdmin() {
+		return ErrNotAdmin
+	}
+
+	var info *recording.Info
+	var err error
+	if start {
+		info, err = OnRecordingStart(room)
+	} else {
+		info, err = OnRecordingStop(room)
+	}
+	if err != nil {
+		return err
+	}
+
+	return messages.Send(client, &messages.ServerMessage{
+		Action:    messages.ActionRecording,
+		Recording: info,
+	})
+}
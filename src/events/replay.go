@@ -0,0 +1,195 @@
+package events
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"vu/ase/streamserver/src/messages"
+	"vu/ase/streamserver/src/recording"
+	"vu/ase/streamserver/src/replay"
+	"vu/ase/streamserver/src/state"
+
+	rtc "github.com/VU-ASE/roverrtc/src"
+)
+
+//
+// A replay serves a recording as if it were a live car. The synthetic car is added to the connected cars of the room without a peer connection,
+// its frames go through the same fan-out as the frames of a live car. Control data that clients send to it is dropped.
+//
+
+// The data format used by admins to start a replay of one of the recordings of the room
+type ReplayRequest struct {
+	Name  string `json:"name"`            // the recording to replay
+	CarId string `json:"carId,omitempty"` // the recorded car to replay, defaults to the first car in the recording
+	Id    string `json:"id,omitempty"`    // the id of the synthetic car, defaults to the id of the recorded car
+	Loop  bool   `json:"loop,omitempty"`  // start over at the end of the recording
+}
+
+// The data format used by admins to stop a replay
+type StopReplayRequest struct {
+	Id string `json:"id"` // the id of the synthetic car
+}
+
+// Called when an admin starts a replay of one of the recordings of the room
+func OnReplayStart(request ReplayRequest, room *state.Room) (*replay.State, error) {
+	path, err := recording.Path(room.RecordingDirectory(), request.Name)
+	if err != nil {
+		return nil, err
+	}
+	return startReplay(path, request.CarId, request.Id, request.Loop, room)
+}
+
+// Replays a recording file (e.g. from the command line) as the car that was recorded
+func StartReplayFile(path string, loop bool, room *state.Room) (*replay.State, error) {
+	return startReplay(path, "", "", loop, room)
+}
+
+func startReplay(path string, recordedCarId string, id string, loop bool, room *state.Room) (*replay.State, error) {
+	reader, err := recording.Open(path, recordedCarId)
+	if err != nil {
+		return nil, err
+	}
+
+	if id == "" {
+		id = reader.CarId
+	}
+	if id == "" || state.IsSessionId(id) {
+		_ = reader.Close()
+		return nil, fmt.Errorf("Invalid car id '%s'", id)
+	}
+	if room.GetPlayer(id) != nil {
+		_ = reader.Close()
+		return nil, fmt.Errorf("Car id '%s' is already used by a replay", id)
+	}
+
+	// The frames carry the timestamps of the recorded car, the offset makes them look recent to the clients
+	first, err := reader.Read(0)
+	if err != nil {
+		_ = reader.Close()
+		return nil, err
+	}
+	car := rtc.NewRTC(id)
+	car.TimestampOffset = first.Timestamp - time.Now().UnixMilli()
+
+	// The player is registered before the car, so that the car without a connection is never mistaken for a live car.
+	// It only starts playing once the car was added, a live car with the same id keeps its subscribers to itself
+	player := replay.New(filepath.Base(path), id, reader, loop, func(record *recording.Record) {
+		forwardCarFrame(car, record.Data, room)
+	})
+	room.SetPlayer(id, player)
+
+	// Connected cars are never overwritten, so a replay cannot take the place of a live car
+	err = removeStaleCar(id, room)
+	if err == nil {
+		err = room.ConnectedCars.Add(id, car, true)
+	}
+	if err != nil {
+		player.Stop()
+		room.RemovePlayer(id)
+		return nil, err
+	}
+
+	player.Play()
+
+	log := room.Log()
+	log.Info().Str("carId", id).Str("recording", player.Name).Int64("duration", reader.Duration()).Msg("Started replay")
+
+	// Let the clients of the synthetic car know that it is connected
+	room.ForEachClientOfCar(id, func(clientId string, client *rtc.RTC) {
+		if err := notifyPeer(client, carStateNotification(car, true, room), room); err != nil {
+			log.Err(err).Str("clientId", clientId).Msg("Could not notify connected client of replay")
+		}
+	})
+
+	state := player.State()
+	return &state, nil
+}
+
+// Called when an admin stops a replay, the synthetic car disconnects
+func OnReplayStop(request StopReplayRequest, room *state.Room) (*replay.State, error) {
+	player := room.GetPlayer(request.Id)
+	if player == nil {
+		return nil, fmt.Errorf("Car '%s' is not a replay", request.Id)
+	}
+	player.Stop()
+	state := player.State()
+
+	log := room.Log()
+
+	car := room.ConnectedCars.Get(request.Id)
+	if car != nil {
+		routedClients := make([]*rtc.RTC, 0)
+		room.ForEachClientOfCar(car.Id, func(id string, client *rtc.RTC) {
+			routedClients = append(routedClients, client)
+			if err := notifyPeer(client, carStateNotification(car, false, room), room); err != nil {
+				log.Err(err).Str("clientId", id).Msg("Could not notify connected client of stopped replay")
+			}
+		})
+
+		room.RemoveCar(car)
+		room.RemovePlayer(car.Id)
+		rerouteClients(routedClients, room)
+	} else {
+		room.RemovePlayer(request.Id)
+	}
+
+	log.Info().Str("carId", request.Id).Msg("Stopped replay")
+	room.RemoveIfEmpty()
+	return &state, nil
+}
+
+// Returns the state of all replays in the room
+func OnReplaysRequested(room *state.Room) []replay.State {
+	states := make([]replay.State, 0)
+	for _, player := range room.GetAllPlayers() {
+		states = append(states, player.State())
+	}
+	return states
+}
+
+// Called when a client pauses, resumes, moves or speeds up the replay it is routed to
+func onClientControlReplay(client *rtc.RTC, control *messages.ReplayControl, room *state.Room) error {
+	if control == nil {
+		return fmt.Errorf("Replay control is missing")
+	}
+	if !room.ClientRole(client.Id).CanControl() {
+		return fmt.Errorf("Cannot control replay: you are not allowed to control the car")
+	}
+
+	car := room.CarForClient(client.Id)
+	if car == nil || room.GetPlayer(car.Id) == nil {
+		return fmt.Errorf("Cannot control replay: you are not routed to a replay")
+	}
+	player := room.GetPlayer(car.Id)
+
+	if control.Speed != nil {
+		if err := player.SetSpeed(*control.Speed); err != nil {
+			return err
+		}
+	}
+	if control.Position != nil {
+		player.SetPosition(*control.Position)
+	}
+	if control.Paused != nil {
+		if *control.Paused {
+			player.Pause()
+		} else {
+			player.Resume()
+		}
+	}
+
+	// Everyone watching the replay sees the same playback
+	log := client.Log()
+	state := player.State()
+	room.ForEachClientOfCar(car.Id, func(id string, r *rtc.RTC) {
+		err := messages.Send(r, &messages.ServerMessage{
+			Action:      messages.ActionReplayState,
+			ReplayState: &state,
+		})
+		if err != nil {
+			log.Err(err).Str("clientId", id).Msg("Could not send replay state")
+		}
+	})
+	return nil
+}
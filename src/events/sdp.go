@@ -0,0 +1,54 @@
+package events
+
+import (
+	rtc "github.com/VU-ASE/roverrtc/src"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// The data format used by clients to send SDP offers. The id is only used as a display label,
+// the client can optionally include the cars it wants to subscribe to
+type ClientRequestSDP struct {
+	rtc.RequestSDP
+	CarIds  []string `json:"carIds,omitempty"`
+	Trickle bool     `json:"trickle,omitempty"` // answer immediately and deliver local candidates through the candidates endpoint
+}
+
+// The data format used by cars to send SDP offers
+type CarRequestSDP struct {
+	rtc.RequestSDP
+	Trickle bool `json:"trickle,omitempty"` // answer immediately and deliver local candidates through the candidates endpoint
+	// The car understands JSON server messages (e.g. maxFrameRate) on its meta channel, next to the protobuf ConfigMessages.
+	// Cars that do not set this only receive ConfigMessages
+	ServerMessages bool `json:"serverMessages,omitempty"`
+}
+
+// The data format used to send back SDP answers. Peers need to use the session id for ICE candidates and meta messages,
+// the answer can still be parsed as a plain webrtc.SessionDescription. Clients also get a session secret, since other
+// clients can learn their session id
+type AnswerSDP struct {
+	webrtc.SessionDescription
+	SessionId     string `json:"sessionId"`
+	SessionSecret string `json:"sessionSecret,omitempty"`
+}
+
+// The data format used by clients to send ICE candidates, the secret proves that the session is their own
+type ClientRequestICE struct {
+	rtc.RequestICE
+	Secret string `json:"secret"`
+}
+
+// The data format used by peers that use trickle ICE to poll for new local candidates
+type RequestCandidates struct {
+	Id        string `json:"id"`                  // the session id
+	Secret    string `json:"secret,omitempty"`    // the session secret, only clients have one
+	After     int    `json:"after"`               // the number of candidates the peer already received
+	Timestamp int64  `json:"timestamp,omitempty"` // timestamp of the sender, cars need to set it since their requests are signed
+}
+
+// The data format used to send back new local candidates
+type CandidatesResponse struct {
+	Candidates []webrtc.ICECandidateInit `json:"candidates"`
+	Next       int                       `json:"next"`     // the value of After for the next request
+	Complete   bool                      `json:"complete"` // no more candidates will follow
+}
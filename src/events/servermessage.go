@@ -0,0 +1,135 @@
+package events
+
+import (
+	"fmt"
+	"sort"
+
+	"vu/ase/streamserver/src/messages"
+	"vu/ase/streamserver/src/state"
+
+	rtc "github.com/VU-ASE/roverrtc/src"
+)
+
+//
+// Actions based on server messages (JSON text messages on the meta channel) by the client
+//
+
+func onClientServerMessage(client *rtc.RTC, data []byte, room *state.Room) {
+	log := client.Log()
+
+	msg, err := messages.Parse(data)
+	if err != nil {
+		log.Err(err).Msg("Could not parse incoming client server message")
+		_ = messages.Send(client, &messages.ServerMessage{
+			Action:  messages.ActionError,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	log.Debug().Str("action", msg.Action).Msg("Received server message")
+
+	switch msg.Action {
+	case messages.ActionSubscribe:
+		err = onClientSubscribe(client, msg.CarIds, room)
+	case messages.ActionListCars:
+		err = messages.Send(client, &messages.ServerMessage{
+			Action: messages.ActionCars,
+			Cars:   describeCars(room.ConnectedCars.UnsafeGetAll(), room),
+		})
+	case messages.ActionListClients:
+		err = messages.Send(client, &messages.ServerMessage{
+			Action:  messages.ActionClients,
+			Clients: describeClients(room.GetAllClientInfo(), room),
+		})
+	case messages.ActionStreamOptions:
+		err = onClientStreamOptions(client, msg.Stream, room)
+	case messages.ActionHeartbeat:
+		err = onClientHeartbeat(client, room)
+	case messages.ActionControlReplay:
+		err = onClientControlReplay(client, msg.Replay, room)
+	case messages.ActionStartRecording:
+		err = onClientRecordingMessage(client, true, room)
+	case messages.ActionStopRecording:
+		err = onClientRecordingMessage(client, false, room)
+	case messages.ActionForceTakeover:
+		err = onClientForceTakeover(client, msg.Message, room)
+	case messages.ActionRevokeControl:
+		err = onClientRevokeControl(client, msg.ControllerId, msg.Message, room)
+	case messages.ActionListAudit:
+		err = onClientListAudit(client, room)
+	default:
+		err = fmt.Errorf("Server message action '%s' is not supported", msg.Action)
+	}
+
+	// Log errors and report them to the client
+	if err != nil {
+		log.Err(err).Msg("Client server message handler returned error")
+		_ = messages.Send(client, &messages.ServerMessage{
+			Action:  messages.ActionError,
+			Message: err.Error(),
+		})
+	}
+}
+
+// Switch the cars a client is subscribed to, this does not require the WebRTC connection to be renegotiated
+// (except for media tracks, which only follow the subscription for clients that negotiate over a WebSocket)
+func onClientSubscribe(client *rtc.RTC, carIds []string, room *state.Room) error {
+	room.Subscribe(client.Id, carIds)
+	updateClientTracks(client, room)
+
+	// Confirm the new subscription
+	err := messages.Send(client, &messages.ServerMessage{
+		Action: messages.ActionSubscription,
+		CarIds: room.Subscription(client.Id),
+		Cars:   describeCars(room.SubscribedCars(client.Id), room),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Clients that do not know about server messages only know about the car that receives their control data
+	car := room.CarForClient(client.Id)
+	if car == nil {
+		return nil
+	}
+	return client.SendMetaMessage(carStateNotification(car, carIsConnected(car, room), room))
+}
+
+// Describe a list of car connections, sorted by id
+func describeCars(cars []*rtc.RTC, room *state.Room) []messages.CarInfo {
+	infos := make([]messages.CarInfo, 0, len(cars))
+	for _, car := range cars {
+		info := messages.DescribeCar(car)
+		status := room.GetCarStatus(car.Id)
+		info.LastError = status.LastError
+		info.TimestampOffset = room.CarTimestampOffset(car)
+		if room.GetPlayer(car.Id) != nil {
+			info.Connected = true
+			info.Replay = true
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Id < infos[j].Id
+	})
+	return infos
+}
+
+// Describe a list of clients, so that other clients can map session ids to labels
+func describeClients(clients []state.ClientInfo, room *state.Room) []messages.ClientDescription {
+	descriptions := make([]messages.ClientDescription, 0, len(clients))
+	for _, client := range clients {
+		description := messages.ClientDescription{
+			Id:    client.Id,
+			Label: client.Label,
+			Role:  string(client.Role),
+		}
+		if sender := room.GetSender(client.Id); sender != nil {
+			stats := sender.Stats()
+			description.Frames = &stats
+		}
+		descriptions = append(descriptions, description)
+	}
+	return descriptions
+}
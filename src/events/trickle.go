@@ -0,0 +1,38 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"vu/ase/streamserver/src/state"
+)
+
+// How long a request for new candidates is held open when there are no new candidates yet
+const CandidatesPollTimeout = 10 * time.Second
+
+// Called when a peer that uses trickle ICE polls for new local candidates (long-polling)
+func OnCandidatesRequested(ctx context.Context, request RequestCandidates, isCar bool, room *state.Room) ([]byte, error) {
+	// Clients can only fetch the candidates of client connections and vice versa
+	if state.IsSessionId(request.Id) == isCar {
+		return nil, fmt.Errorf("Connection with id %s does not exist", request.Id)
+	}
+	// Cars are authenticated by their signature, clients need to prove that the session is their own
+	if !isCar && !room.VerifySessionSecret(request.Id, request.Secret) {
+		return nil, fmt.Errorf("Connection with id %s does not exist", request.Id)
+	}
+
+	gatherer := room.GetGatherer(request.Id)
+	if gatherer == nil {
+		return nil, fmt.Errorf("Connection with id %s does not exist or does not use trickle ICE", request.Id)
+	}
+
+	candidates, next, complete := gatherer.Wait(ctx, request.After, CandidatesPollTimeout)
+
+	return json.Marshal(CandidatesResponse{
+		Candidates: candidates,
+		Next:       next,
+		Complete:   complete,
+	})
+}
@@ -0,0 +1,70 @@
+package events
+
+import (
+	"fmt"
+
+	"vu/ase/streamserver/src/messages"
+	"vu/ase/streamserver/src/state"
+
+	rtc "github.com/VU-ASE/roverrtc/src"
+)
+
+//
+// A car keeps executing the last control message it received. To make sure it does not drive off when its controller
+// goes silent (e.g. a frozen browser or a stalled network), the server sends it a stop message and lets all clients know.
+// Under the autonomous control policy, the car is handed back to its own driving instead.
+//
+
+// Feeds the watchdog of the room with a control message that a client sent to a car, only the active controller is watched
+func feedWatchdog(client *rtc.RTC, car *rtc.RTC, room *state.Room) {
+	room.Lock.RLock()
+	activeController := room.ActiveController
+	room.Lock.RUnlock()
+
+	if activeController != client.Id {
+		return
+	}
+
+	room.Watchdog.Feed(client.Id, car.Id, func(controllerId string, carId string) {
+		stopCar(controllerId, carId, fmt.Sprintf("The active controller sent no control data for %s", room.Server.Config.Control.WatchdogTimeout), room)
+	})
+}
+
+// Stops the car of a controller that disconnected or released control right away, without waiting for the watchdog
+func onControllerGone(controllerId string, reason string, room *state.Room) {
+	if carId, ok := room.Watchdog.Disarm(controllerId); ok {
+		stopCar(controllerId, carId, reason, room)
+	}
+}
+
+// Sends the stop message to a car and notifies all clients in the room
+func stopCar(controllerId string, carId string, reason string, room *state.Room) {
+	log := room.Log()
+
+	// Synthetic cars do not execute control data
+	car := room.ConnectedCars.Get(carId)
+	if car == nil || car.Pc == nil {
+		return
+	}
+
+	log.Warn().Str("carId", carId).Str("controllerId", controllerId).Str("reason", reason).Msg("Stopping car")
+	if room.Server.Policy.Autonomous() {
+		if err := notifyPeer(car, controlStateNotification(""), room); err != nil {
+			log.Err(err).Str("carId", carId).Msg("Could not hand car back to autonomous driving")
+		}
+	} else if err := car.SendControlBytes(room.Server.StopMessage); err != nil {
+		log.Err(err).Str("carId", carId).Msg("Could not send stop message to car")
+	}
+
+	notification := &messages.ServerMessage{
+		Action:       messages.ActionCarStopped,
+		CarIds:       []string{carId},
+		ControllerId: controllerId,
+		Message:      reason,
+	}
+	room.ConnectedClients.ForEach(func(id string, r *rtc.RTC) {
+		if err := messages.Send(r, notification); err != nil {
+			log.Err(err).Str("clientId", id).Msg("Could not notify client of stopped car")
+		}
+	})
+}
@@ -0,0 +1,288 @@
+package events
+
+import (
+	"fmt"
+
+	"vu/ase/streamserver/src/peerconnection"
+	"vu/ase/streamserver/src/signaling"
+	"vu/ase/streamserver/src/state"
+
+	pb_remote_config_messages "github.com/VU-ASE/rovercom/packages/go"
+
+	rtc "github.com/VU-ASE/roverrtc/src"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// Returned when a peer cannot be renegotiated because it does not use WebSocket signaling
+var ErrNoSignaling = fmt.Errorf("Peer does not use WebSocket signaling")
+
+// Called for every signaling message that a peer sends over its WebSocket
+func OnSignalingMessage(session *signaling.Session, msg signaling.Message, receivedAt int64, room *state.Room) error {
+	switch msg.Type {
+	case signaling.TypeOffer:
+		return onSignalingOffer(session, msg, receivedAt, room)
+	case signaling.TypeAnswer:
+		return onSignalingAnswer(session, msg, room)
+	case signaling.TypeCandidate:
+		return onSignalingCandidate(session, msg, room)
+	case signaling.TypeRestart:
+		r := signalingConnection(session, room)
+		if r == nil {
+			return fmt.Errorf("Cannot restart ICE: send an offer first")
+		}
+		return Renegotiate(r, true, room)
+	default:
+		return fmt.Errorf("Unknown signaling message type '%s'", msg.Type)
+	}
+}
+
+// Called when the WebSocket of a peer is closed. The peer connection itself stays alive, but can no longer be renegotiated
+func OnSignalingClosed(session *signaling.Session, room *state.Room) {
+	session.Negotiation.Lock()
+	defer session.Negotiation.Unlock()
+
+	if session.PeerId != "" {
+		room.RemoveSignaling(session.PeerId, session)
+	}
+}
+
+// The first offer creates the peer connection, later offers renegotiate it
+func onSignalingOffer(session *signaling.Session, msg signaling.Message, receivedAt int64, room *state.Room) error {
+	if msg.SDP == nil {
+		return fmt.Errorf("Offer does not contain an SDP")
+	}
+
+	session.Negotiation.Lock()
+	defer session.Negotiation.Unlock()
+
+	r := signalingConnection(session, room)
+	if r == nil {
+		return connectSignalingPeer(session, msg, receivedAt, room)
+	}
+
+	log := r.Log()
+
+	// When both sides sent an offer at the same time, the server gives in and handles the offer of the peer
+	if r.Pc.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+		log.Debug().Msg("Rolling back local offer in favor of the offer of the peer")
+		if err := r.Pc.SetLocalDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeRollback}); err != nil {
+			return fmt.Errorf("Could not roll back local offer: %v", err)
+		}
+	}
+
+	if err := r.Pc.SetRemoteDescription(*msg.SDP); err != nil {
+		return fmt.Errorf("Could not set remote description: %v", err)
+	}
+	answer, err := r.Pc.CreateAnswer(nil)
+	if err != nil {
+		return fmt.Errorf("Could not create answer: %v", err)
+	}
+	if err := r.Pc.SetLocalDescription(answer); err != nil {
+		return fmt.Errorf("Could not set local description: %v", err)
+	}
+
+	log.Info().Msg("Renegotiated connection on request of the peer")
+
+	return session.Send(signaling.Message{
+		Type: signaling.TypeAnswer,
+		SDP:  r.Pc.LocalDescription(),
+	})
+}
+
+// Creates the peer connection for the first offer on a WebSocket, the local candidates are trickled over the WebSocket
+func connectSignalingPeer(session *signaling.Session, msg signaling.Message, receivedAt int64, room *state.Room) error {
+	gatherer := peerconnection.NewGatherer()
+	gatherer.OnCandidate(func(candidate *webrtc.ICECandidateInit) {
+		// Wait until the description these candidates belong to has been sent
+		session.Negotiation.Lock()
+		defer session.Negotiation.Unlock()
+
+		err := session.Send(signaling.Message{
+			Type:      signaling.TypeCandidate,
+			Candidate: candidate,
+		})
+		if err != nil {
+			log.Err(err).Str("peerId", session.PeerId).Msg("Could not send local candidate over WebSocket")
+		}
+	})
+
+	var answer *AnswerSDP
+	var err error
+	if session.IsCar() {
+		// Without a timestamp, the clock of the car is assumed to be in sync with ours
+		timestamp := msg.Timestamp
+		if timestamp == 0 {
+			timestamp = receivedAt
+		}
+
+		answer, err = connectCar(CarRequestSDP{
+			RequestSDP: rtc.RequestSDP{
+				Offer:     *msg.SDP,
+				Id:        session.CarId,
+				Timestamp: timestamp,
+			},
+			ServerMessages: msg.ServerMessages,
+		}, receivedAt, gatherer, room)
+	} else {
+		answer, err = connectClient(ClientRequestSDP{
+			RequestSDP: rtc.RequestSDP{
+				Offer: *msg.SDP,
+				Id:    msg.Label,
+			},
+			CarIds: msg.CarIds,
+		}, session.Role, gatherer, room)
+	}
+	if err != nil {
+		return err
+	}
+
+	session.PeerId = answer.SessionId
+	room.SetSignaling(answer.SessionId, session)
+
+	return session.Send(signaling.Message{
+		Type:      signaling.TypeAnswer,
+		SDP:       &answer.SessionDescription,
+		SessionId: answer.SessionId,
+	})
+}
+
+// Called when a peer answers an offer of the server
+func onSignalingAnswer(session *signaling.Session, msg signaling.Message, room *state.Room) error {
+	if msg.SDP == nil {
+		return fmt.Errorf("Answer does not contain an SDP")
+	}
+
+	session.Negotiation.Lock()
+	defer session.Negotiation.Unlock()
+
+	r := signalingConnection(session, room)
+	if r == nil {
+		return fmt.Errorf("Cannot process answer: there is no connection to renegotiate")
+	}
+
+	if err := r.Pc.SetRemoteDescription(*msg.SDP); err != nil {
+		return fmt.Errorf("Could not set remote description: %v", err)
+	}
+
+	log := r.Log()
+	log.Info().Msg("Renegotiated connection")
+	return nil
+}
+
+// Called when a peer trickles one of its candidates
+func onSignalingCandidate(session *signaling.Session, msg signaling.Message, room *state.Room) error {
+	session.Negotiation.Lock()
+	r := signalingConnection(session, room)
+	session.Negotiation.Unlock()
+
+	if r == nil {
+		return fmt.Errorf("Cannot add candidate: send an offer first")
+	}
+
+	// The peer finished gathering, there is nothing to do for us
+	if msg.Candidate == nil {
+		return nil
+	}
+
+	return r.Pc.AddICECandidate(*msg.Candidate)
+}
+
+// Returns the connection that is negotiated over a session, or nil if there is none (anymore)
+func signalingConnection(session *signaling.Session, room *state.Room) *rtc.RTC {
+	if session.PeerId == "" {
+		return nil
+	}
+
+	var r *rtc.RTC
+	if session.IsCar() {
+		r = room.ConnectedCars.Get(session.PeerId)
+	} else {
+		r = room.ConnectedClients.Get(session.PeerId)
+	}
+	if r == nil || r.Pc == nil {
+		return nil
+	}
+	return r
+}
+
+// Sends a new offer to a peer that negotiates over a WebSocket, e.g. to restart ICE or to add tracks.
+// The peer is expected to reply with an answer
+func Renegotiate(r *rtc.RTC, iceRestart bool, room *state.Room) error {
+	session := room.GetSignaling(r.Id)
+	if session == nil {
+		return ErrNoSignaling
+	}
+
+	session.Negotiation.Lock()
+	defer session.Negotiation.Unlock()
+
+	return renegotiate(r, iceRestart, session)
+}
+
+// Sends a new offer over a signaling session, the caller needs to hold the negotiation lock of the session
+func renegotiate(r *rtc.RTC, iceRestart bool, session *signaling.Session) error {
+	if r.Pc == nil {
+		return fmt.Errorf("Cannot renegotiate: connection was closed")
+	}
+	if r.Pc.SignalingState() != webrtc.SignalingStateStable {
+		return fmt.Errorf("Cannot renegotiate: negotiation already in progress")
+	}
+
+	offer, err := r.Pc.CreateOffer(&webrtc.OfferOptions{ICERestart: iceRestart})
+	if err != nil {
+		return fmt.Errorf("Could not create offer: %v", err)
+	}
+	if err := r.Pc.SetLocalDescription(offer); err != nil {
+		return fmt.Errorf("Could not set local description: %v", err)
+	}
+
+	log := r.Log()
+	log.Info().Bool("iceRestart", iceRestart).Msg("Sending offer to renegotiate connection")
+
+	return session.Send(signaling.Message{
+		Type: signaling.TypeOffer,
+		SDP:  r.Pc.LocalDescription(),
+	})
+}
+
+// Tries to restart ICE for a peer whose connection was interrupted, returns true if an ICE restart was started
+func restartICE(r *rtc.RTC, room *state.Room) bool {
+	err := Renegotiate(r, true, room)
+	if err == ErrNoSignaling {
+		return false
+	}
+
+	log := r.Log()
+	if err != nil {
+		log.Err(err).Msg("Could not restart ICE")
+		return false
+	}
+	return true
+}
+
+// Lets a peer that negotiates over a WebSocket know that its connection was closed
+func closeSignaling(peerId string, room *state.Room) {
+	session := room.GetSignaling(peerId)
+	if session == nil {
+		return
+	}
+	room.RemoveSignaling(peerId, session)
+
+	err := session.Send(signaling.Message{Type: signaling.TypeClosed})
+	if err != nil {
+		log.Err(err).Str("peerId", peerId).Msg("Could not notify peer of closed connection")
+	}
+}
+
+// Sends a server notification to a peer over its meta channel, and over its WebSocket (if any) so that it arrives even
+// before the data channels are open. Notifications describe a state, so peers can safely ignore duplicates
+func notifyPeer(r *rtc.RTC, notification *pb_remote_config_messages.ConfigMessage, room *state.Room) error {
+	if session := room.GetSignaling(r.Id); session != nil {
+		if err := session.Notify(notification); err != nil {
+			log.Err(err).Str("peerId", r.Id).Msg("Could not send notification over WebSocket")
+		}
+	}
+	return r.SendMetaMessage(notification)
+}
@@ -0,0 +1,171 @@
+package events
+
+import (
+	"fmt"
+	"strings"
+
+	"vu/ase/streamserver/src/auth"
+	"vu/ase/streamserver/src/state"
+
+	rtc "github.com/VU-ASE/roverrtc/src"
+
+	"github.com/pion/webrtc/v4"
+)
+
+//
+// WHIP (ingest, used by cars) and WHEP (egress, used by clients) let standard tools connect with plain SDP bodies instead of our JSON requests.
+// The offers end up in the same connection flows as the JSON endpoints. The answer always contains all server candidates,
+// the peer can trickle its own candidates as SDP fragments and ends its session by deleting its resource.
+//
+
+// Returned when a WHIP/WHEP resource does not exist (anymore)
+var ErrUnknownResource = fmt.Errorf("Resource does not exist")
+
+// The answer to a WHIP/WHEP offer, together with the resource id that identifies the session from now on
+type ResourceAnswer struct {
+	AnswerSDP
+	ResourceId string
+}
+
+// Called when a car sends an offer to the WHIP endpoint
+func OnCarWHIPOffer(carId string, offer string, receivedAt int64, room *state.Room) (*ResourceAnswer, error) {
+	answer, err := connectCar(CarRequestSDP{
+		RequestSDP: rtc.RequestSDP{
+			Offer: webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer},
+			Id:    carId,
+			// WHIP offers do not carry a timestamp, so the clock of the car is assumed to be in sync with ours
+			Timestamp: receivedAt,
+		},
+	}, receivedAt, nil, room)
+	if err != nil {
+		return nil, err
+	}
+
+	return newResourceAnswer(answer, room)
+}
+
+// Called when a client sends an offer to the WHEP endpoint
+func OnClientWHEPOffer(label string, carIds []string, offer string, role auth.Role, room *state.Room) (*ResourceAnswer, error) {
+	answer, err := connectClient(ClientRequestSDP{
+		RequestSDP: rtc.RequestSDP{
+			Offer: webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer},
+			Id:    label,
+		},
+		CarIds: carIds,
+	}, role, nil, room)
+	if err != nil {
+		return nil, err
+	}
+
+	return newResourceAnswer(answer, room)
+}
+
+func newResourceAnswer(answer *AnswerSDP, room *state.Room) (*ResourceAnswer, error) {
+	resourceId, err := room.NewResource(answer.SessionId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ResourceAnswer{
+		AnswerSDP:  *answer,
+		ResourceId: resourceId,
+	}, nil
+}
+
+// Returns the id of the peer that owns a resource, so that the caller can check whether the requester may use it
+func ResourcePeer(resourceId string, isCar bool, room *state.Room) (string, error) {
+	id := room.ResourcePeer(resourceId)
+	if id == "" || state.IsSessionId(id) == isCar {
+		return "", ErrUnknownResource
+	}
+	return id, nil
+}
+
+// Called when a WHIP/WHEP peer trickles its ICE candidates as an SDP fragment (application/trickle-ice-sdpfrag)
+func OnResourceCandidatesReceived(resourceId string, isCar bool, fragment string, room *state.Room) error {
+	r, err := resourceConnection(resourceId, isCar, room)
+	if err != nil {
+		return err
+	}
+
+	log := r.Log()
+
+	candidates := parseSDPFragment(fragment)
+	for _, candidate := range candidates {
+		if err := r.Pc.AddICECandidate(candidate); err != nil {
+			return err
+		}
+	}
+
+	log.Info().Int("count", len(candidates)).Msg("Received trickled ICE candidates")
+	return nil
+}
+
+// Called when a WHIP/WHEP peer ends its session. Closing the connection triggers the usual disconnect handling
+func OnResourceDeleted(resourceId string, isCar bool, room *state.Room) error {
+	r, err := resourceConnection(resourceId, isCar, room)
+	if err != nil {
+		return err
+	}
+
+	log := r.Log()
+	log.Info().Msg("Session ended by peer")
+
+	room.RemoveResources(r.Id)
+	return r.Pc.Close()
+}
+
+func resourceConnection(resourceId string, isCar bool, room *state.Room) (*rtc.RTC, error) {
+	id, err := ResourcePeer(resourceId, isCar, room)
+	if err != nil {
+		return nil, err
+	}
+
+	var r *rtc.RTC
+	if isCar {
+		r = room.ConnectedCars.Get(id)
+	} else {
+		r = room.ConnectedClients.Get(id)
+	}
+	if r == nil || r.Pc == nil {
+		return nil, ErrUnknownResource
+	}
+	return r, nil
+}
+
+// Collects the candidates from an SDP fragment, together with the media section and ICE credentials they belong to
+func parseSDPFragment(fragment string) []webrtc.ICECandidateInit {
+	candidates := make([]webrtc.ICECandidateInit, 0)
+
+	var ufrag *string
+	var mid *string
+	var mLineIndex *uint16
+	for _, line := range strings.Split(fragment, "\n") {
+		line = strings.TrimSpace(line)
+
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			value := strings.TrimPrefix(line, "a=ice-ufrag:")
+			ufrag = &value
+		case strings.HasPrefix(line, "m="):
+			index := uint16(0)
+			if mLineIndex != nil {
+				index = *mLineIndex + 1
+			}
+			mLineIndex = &index
+			mid = nil
+		case strings.HasPrefix(line, "a=mid:"):
+			value := strings.TrimPrefix(line, "a=mid:")
+			mid = &value
+		case strings.HasPrefix(line, "a=candidate:"):
+			candidates = append(candidates, webrtc.ICECandidateInit{
+				Candidate:        strings.TrimPrefix(line, "a="),
+				SDPMid:           mid,
+				SDPMLineIndex:    mLineIndex,
+				UsernameFragment: ufrag,
+			})
+		}
+	}
+
+	return candidates
+}
@@ -0,0 +1,175 @@
+package fanout
+
+import (
+	"math"
+	"time"
+)
+
+//
+// A queue bounds how far a client can fall behind, but a client on a bad link still receives every frame late. To keep the
+// latency of a client under a target, its sender estimates how long a frame takes to reach the client (from what is still
+// buffered, how fast the buffer drains and the round trip time of the connection) and leaves out frames when it takes too long.
+// The frame rate is lowered multiplicatively when the client falls behind, and raised gradually when it has room to spare.
+//
+
+// How often the frame rate of a client is adapted
+const adaptInterval = time.Second
+
+const (
+	minFrameRate     = 1.0  // frames per second, a client always receives some frames
+	rateDecrease     = 0.7  // the frame rate is multiplied by this when the latency is over the target
+	rateIncrease     = 1.25 // the frame rate is multiplied by this when the latency is well under the target
+	decimationJitter = 0.9  // frames may arrive this much earlier than the frame rate allows, since cars do not send at exact intervals
+)
+
+// Statistics of the transport (the SCTP association) of a client connection
+type TransportStats struct {
+	RoundTripTime    time.Duration // smoothed, 0 if it was not measured yet
+	CongestionWindow uint32        // bytes, 0 if unknown
+}
+
+// The frame rate a client receives
+type FrameRate struct {
+	Effective   float64 `json:"effective"`   // frames per second the client receives
+	Source      float64 `json:"source"`      // frames per second the cars of the client send
+	Latency     int64   `json:"latency"`     // estimated milliseconds until a frame reaches the client
+	Constrained bool    `json:"constrained"` // frames are left out because the client cannot keep up
+}
+
+type rateAdapter struct {
+	target       time.Duration // 0 disables adaptation
+	limit        float64       // frames per second, 0 does not limit
+	maxFrameRate float64       // the maximum the client asked for, 0 does not limit
+	lastAccepted time.Time
+	frameBytes   float64 // moving average of the frame size
+	rate         FrameRate
+
+	// Measured since the last adaptation
+	framesIn     int
+	bytesSent    uint64
+	lastBuffered uint64
+	lastAdapted  time.Time
+}
+
+func newRateAdapter(target time.Duration, now time.Time) *rateAdapter {
+	return &rateAdapter{
+		target:      target,
+		lastAdapted: now,
+	}
+}
+
+// Returns true if a frame that arrives now is passed on to the client, false if it is left out to lower the frame rate
+func (a *rateAdapter) accept(now time.Time) bool {
+	a.framesIn++
+	limit := a.effectiveLimit()
+	if limit <= 0 {
+		return true
+	}
+
+	interval := time.Duration(float64(time.Second) / limit)
+	if now.Sub(a.lastAccepted) < time.Duration(float64(interval)*decimationJitter) {
+		return false
+	}
+	a.lastAccepted = now
+	return true
+}
+
+// The lowest of the adapted frame rate and the maximum of the client, 0 if neither limits the frame rate
+func (a *rateAdapter) effectiveLimit() float64 {
+	if a.maxFrameRate > 0 && (a.limit <= 0 || a.maxFrameRate < a.limit) {
+		return a.maxFrameRate
+	}
+	return a.limit
+}
+
+// Records a frame that was handed to the connection
+func (a *rateAdapter) sent(size int) {
+	a.bytesSent += uint64(size)
+	if a.frameBytes == 0 {
+		a.frameBytes = float64(size)
+	} else {
+		a.frameBytes = 0.9*a.frameBytes + 0.1*float64(size)
+	}
+}
+
+// Estimates the latency of the client and adapts its frame rate. Buffered is what the connection still needs to send,
+// queued is what the sender still needs to hand to the connection. Returns true if the client should be told about its new frame rate
+func (a *rateAdapter) adapt(now time.Time, buffered uint64, queued int, transport TransportStats) (FrameRate, bool) {
+	elapsed := now.Sub(a.lastAdapted).Seconds()
+	if a.target <= 0 || elapsed <= 0 {
+		return a.rate, false
+	}
+
+	source := float64(a.framesIn) / elapsed
+	drained := float64(a.bytesSent) + float64(a.lastBuffered) - float64(buffered)
+	backlog := float64(buffered) + float64(queued)
+
+	// What went through is a lower bound of what the connection can send (the car might just not send more), the congestion
+	// window per round trip is an estimate of what it could send
+	throughput := max(0, drained/elapsed)
+	capacity := 0.0
+	if transport.RoundTripTime > 0 && transport.CongestionWindow > 0 {
+		capacity = float64(transport.CongestionWindow) / transport.RoundTripTime.Seconds()
+		throughput = max(throughput, capacity)
+	}
+
+	// A frame waits for everything before it to drain, and then travels half a round trip
+	latency := transport.RoundTripTime / 2
+	if backlog > 0 {
+		if a.lastBuffered > 0 && drained <= 0 {
+			// Nothing went through at all since the last adaptation
+			latency += max(2*a.target, now.Sub(a.lastAdapted))
+		} else if throughput > 0 {
+			latency += time.Duration(backlog / throughput * float64(time.Second))
+		}
+	}
+
+	current := a.effectiveLimit()
+	if current <= 0 || current > source {
+		current = source
+	}
+	if latency > a.target {
+		a.limit = max(minFrameRate, current*rateDecrease)
+	} else if latency < a.target/2 && a.limit > 0 {
+		a.limit = a.limit * rateIncrease
+		if a.limit >= source {
+			a.limit = 0
+		}
+	}
+
+	// A client that falls behind cannot receive more frames than its connection can send. Only the congestion window tells
+	// what the connection could send, what went through is bounded by the frame rate itself and would keep it from recovering
+	if latency > a.target && capacity > 0 && a.frameBytes > 0 {
+		frames := capacity / a.frameBytes
+		if (a.limit <= 0 && source > frames) || (a.limit > 0 && a.limit > frames) {
+			a.limit = max(minFrameRate, frames)
+		}
+	}
+
+	rate := FrameRate{
+		Effective:   source,
+		Source:      source,
+		Latency:     latency.Milliseconds(),
+		Constrained: a.limit > 0 && a.limit < source,
+	}
+	if limit := a.effectiveLimit(); limit > 0 && limit < source {
+		rate.Effective = limit
+	}
+	rate.Effective = math.Round(rate.Effective*100) / 100
+	rate.Source = math.Round(rate.Source*100) / 100
+
+	// Only changes that matter to the client are reported, not every fluctuation of the frame rate of the car
+	changed := rate.Constrained != a.rate.Constrained || math.Abs(rate.Effective-a.rate.Effective) >= max(1, 0.1*a.rate.Effective)
+	if changed {
+		a.rate = rate
+	} else {
+		a.rate.Latency = rate.Latency
+		a.rate.Source = rate.Source
+	}
+
+	a.framesIn = 0
+	a.bytesSent = 0
+	a.lastBuffered = buffered
+	a.lastAdapted = now
+	return rate, changed
+}
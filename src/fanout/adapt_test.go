@@ -0,0 +1,91 @@
+package fanout
+
+import (
+	"testing"
+	"time"
+)
+
+// A client whose connection can send a fixed number of bytes per second, receiving the frames of a car through an adapter
+type simulation struct {
+	adapter   *rateAdapter
+	capacity  float64 // bytes per second
+	buffered  float64
+	now       time.Time
+	nextAdapt time.Time
+	rate      FrameRate
+}
+
+func newSimulation(target time.Duration, capacity float64) *simulation {
+	now := time.Now()
+	return &simulation{
+		adapter:   newRateAdapter(target, now),
+		capacity:  capacity,
+		now:       now,
+		nextAdapt: now.Add(adaptInterval),
+	}
+}
+
+// Sends the frames of a car for the given duration, adapting the frame rate like a sender does
+func (s *simulation) run(duration time.Duration, sourceRate float64, frameSize int) {
+	frameInterval := time.Duration(float64(time.Second) / sourceRate)
+	for end := s.now.Add(duration); s.now.Before(end); s.now = s.now.Add(frameInterval) {
+		if s.adapter.accept(s.now) {
+			s.adapter.sent(frameSize)
+			s.buffered += float64(frameSize)
+		}
+		s.buffered = max(0, s.buffered-s.capacity*frameInterval.Seconds())
+
+		if !s.now.Before(s.nextAdapt) {
+			s.rate, _ = s.adapter.adapt(s.now, uint64(s.buffered), 0, TransportStats{})
+			s.nextAdapt = s.nextAdapt.Add(adaptInterval)
+		}
+	}
+}
+
+func TestRateAdapterCongestionAndRecovery(t *testing.T) {
+	const sourceRate = 30.0
+	const frameSize = 10000
+	target := 250 * time.Millisecond
+
+	// The connection can only send 10 of the 30 frames per second
+	s := newSimulation(target, 10*frameSize)
+	s.run(20*time.Second, sourceRate, frameSize)
+	if !s.rate.Constrained {
+		t.Fatalf("Frame rate is not constrained on a congested connection: %+v", s.rate)
+	}
+	if s.rate.Effective > 0.5*sourceRate {
+		t.Errorf("Effective frame rate %.2f is not lowered to what the connection can send", s.rate.Effective)
+	}
+	if latency := time.Duration(s.buffered / s.capacity * float64(time.Second)); latency > 4*target {
+		t.Errorf("Latency of %s is not kept near the target of %s", latency, target)
+	}
+
+	// The connection recovers, so the client should receive every frame again
+	s.capacity = 100 * frameSize
+	s.run(30*time.Second, sourceRate, frameSize)
+	if s.rate.Constrained {
+		t.Errorf("Frame rate is still constrained after the connection recovered: %+v", s.rate)
+	}
+	if s.rate.Effective < 0.9*sourceRate {
+		t.Errorf("Effective frame rate %.2f did not recover to the source frame rate %.2f", s.rate.Effective, sourceRate)
+	}
+}
+
+func TestRateAdapterMaxFrameRate(t *testing.T) {
+	now := time.Now()
+	a := newRateAdapter(0, now)
+	a.maxFrameRate = 5
+
+	accepted := 0
+	for i := 0; i < 300; i++ {
+		if a.accept(now) {
+			accepted++
+		}
+		now = now.Add(time.Second / 30)
+	}
+
+	// 10 seconds at 30 frames per second, capped to 5 frames per second
+	if accepted < 45 || accepted > 55 {
+		t.Errorf("Accepted %d frames in 10 seconds with a maximum of 5 frames per second", accepted)
+	}
+}
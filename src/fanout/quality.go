@@ -0,0 +1,131 @@
+package fanout
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"sync"
+
+	pb_module_outputs "github.com/VU-ASE/rovercom/packages/go/outputs"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/protobuf/proto"
+)
+
+//
+// Clients can ask for frames in a lower quality (e.g. on a phone, or to save bandwidth), which lowers the resolution of the
+// JPEG debug frames of the camera. Frames without a camera image are sent as they are. Overlays (trajectories and canvases)
+// carry their own dimensions, so they are not changed.
+//
+
+// The quality tiers a client can pick from
+const (
+	QualityHigh   = "high"   // frames as the car sends them
+	QualityMedium = "medium" // half the width and height of the car frames
+	QualityLow    = "low"    // a quarter of the width and height of the car frames
+)
+
+// Returns true if the quality tier exists
+func ValidQuality(quality string) bool {
+	return quality == QualityHigh || quality == QualityMedium || quality == QualityLow
+}
+
+// A frame that is sent to several clients, in the quality each of them picked. The frame is scaled on the goroutines of
+// the senders (not on the goroutine of the car), and at most once for every quality
+type Frame struct {
+	Data   []byte // the frame as the car sent it
+	scaled map[string][]byte
+	lock   *sync.Mutex
+}
+
+func NewFrame(data []byte) *Frame {
+	return &Frame{
+		Data:   data,
+		scaled: make(map[string][]byte),
+		lock:   &sync.Mutex{},
+	}
+}
+
+// Returns the frame in the given quality, the frame is sent as it is if it cannot be scaled
+func (f *Frame) In(quality string) []byte {
+	if quality == "" || quality == QualityHigh {
+		return f.Data
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if data, ok := f.scaled[quality]; ok {
+		return data
+	}
+	data, err := scaleFrame(f.Data, quality)
+	if err != nil {
+		log.Debug().Err(err).Str("quality", quality).Msg("Could not scale frame, sending it as it is")
+		data = f.Data
+	}
+	f.scaled[quality] = data
+	return data
+}
+
+// Lowers the resolution of the camera image in a sensor output
+func scaleFrame(data []byte, quality string) ([]byte, error) {
+	factor, jpegQuality := 1, jpeg.DefaultQuality
+	switch quality {
+	case QualityMedium:
+		factor, jpegQuality = 2, 70
+	case QualityLow:
+		factor, jpegQuality = 4, 50
+	default:
+		return nil, fmt.Errorf("Unknown quality '%s'", quality)
+	}
+
+	output := pb_module_outputs.SensorOutput{}
+	if err := proto.Unmarshal(data, &output); err != nil {
+		return nil, err
+	}
+	debugFrame := output.GetCameraOutput().GetDebugFrame()
+	if debugFrame == nil || len(debugFrame.Jpeg) == 0 {
+		return data, nil
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(debugFrame.Jpeg))
+	if err != nil {
+		return nil, err
+	}
+	buffer := bytes.Buffer{}
+	if err := jpeg.Encode(&buffer, downscale(img, factor), &jpeg.Options{Quality: jpegQuality}); err != nil {
+		return nil, err
+	}
+
+	debugFrame.Jpeg = buffer.Bytes()
+	return proto.Marshal(&output)
+}
+
+// Shrinks an image by an integer factor, every pixel is the average of a factor x factor block of the original
+func downscale(img image.Image, factor int) image.Image {
+	bounds := img.Bounds()
+	width, height := max(1, bounds.Dx()/factor), max(1, bounds.Dy()/factor)
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var r, g, b, n uint32
+			for dy := 0; dy < factor; dy++ {
+				for dx := 0; dx < factor; dx++ {
+					px, py := bounds.Min.X+x*factor+dx, bounds.Min.Y+y*factor+dy
+					if px >= bounds.Max.X || py >= bounds.Max.Y {
+						continue
+					}
+					pr, pg, pb, _ := img.At(px, py).RGBA()
+					r, g, b, n = r+pr, g+pg, b+pb, n+1
+				}
+			}
+			i := scaled.PixOffset(x, y)
+			scaled.Pix[i+0] = uint8(r / n >> 8)
+			scaled.Pix[i+1] = uint8(g / n >> 8)
+			scaled.Pix[i+2] = uint8(b / n >> 8)
+			scaled.Pix[i+3] = 255
+		}
+	}
+	return scaled
+}
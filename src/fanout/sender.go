@@ -0,0 +1,293 @@
+package fanout
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+//
+// Every client gets its own sender, which sends frames and messages to the client on its own goroutine. This way, one slow or
+// congested client cannot delay the frames of the other clients, or back up the data channels of the car the frames come from.
+// Frames are queued up to a limit, after which the oldest frames are dropped. Messages (control and meta) are never dropped.
+// Frames can also be left out on purpose, to keep the latency of a client on a bad link low (see adapt.go) or because the client
+// asked for fewer frames (see Options).
+//
+
+// Frames are only handed to the connection of a client while it buffers less than this many bytes. A congested client
+// builds up its queue in the sender (where old frames are dropped) instead of in its data channel (where they are not)
+const maxBufferedAmount = 1024 * 1024
+
+// How often a sender checks whether a congested client caught up
+const congestionPollInterval = 10 * time.Millisecond
+
+// Describes how well a sender keeps up with the frames it is given
+type Stats struct {
+	SentFrames    uint64    `json:"sentFrames"`
+	DroppedFrames uint64    `json:"droppedFrames"` // frames that were dropped because the queue was full
+	SkippedFrames uint64    `json:"skippedFrames"` // frames that were left out to keep the latency under the target, or the frame rate under the maximum of the client
+	QueuedFrames  int       `json:"queuedFrames"`
+	FrameRate     FrameRate `json:"frameRate"`
+	Options       Options   `json:"options"`
+}
+
+// What a client wants to receive, as chosen by the client
+type Options struct {
+	MaxFrameRate float64 `json:"maxFrameRate"` // frames per second, 0 does not limit
+	Paused       bool    `json:"paused"`       // no frames are sent at all (e.g. while the client is not visible)
+	Quality      string  `json:"quality"`      // one of the quality tiers
+}
+
+// The connection of a client, as far as a sender needs to know it
+type Connection interface {
+	SendFrame(data []byte) error
+	BufferedAmount() uint64 // the number of bytes the frame channel still needs to send
+	TransportStats() TransportStats
+}
+
+type Sender struct {
+	ClientId    string
+	maxFrames   int
+	conn        Connection
+	adapter     *rateAdapter
+	onFrameRate func(rate FrameRate) // called when the frame rate of the client changed
+	options     Options
+	frames      []*Frame       // oldest first
+	messages    []func() error // oldest first, sent before any frame
+	stats       Stats
+	wake        chan struct{} // signals the goroutine that there is something to send
+	done        chan struct{} // closed to stop the goroutine
+	stopped     chan struct{} // closed when the goroutine stopped
+	stopOnce    *sync.Once
+	lock        *sync.Mutex
+}
+
+// Creates a sender that queues at most maxFrames frames, and starts its goroutine. If targetLatency is not 0, the frame rate
+// is lowered whenever the client cannot receive frames that fast, onFrameRate is called on the goroutine of the sender when it changes
+func NewSender(clientId string, maxFrames int, targetLatency time.Duration, conn Connection, onFrameRate func(rate FrameRate)) *Sender {
+	s := &Sender{
+		ClientId:    clientId,
+		maxFrames:   max(1, maxFrames),
+		conn:        conn,
+		adapter:     newRateAdapter(targetLatency, time.Now()),
+		onFrameRate: onFrameRate,
+		options:     Options{Quality: QualityHigh},
+		frames:      make([]*Frame, 0),
+		messages:    make([]func() error, 0),
+		wake:        make(chan struct{}, 1),
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+		stopOnce:    &sync.Once{},
+		lock:        &sync.Mutex{},
+	}
+	go s.run()
+	return s
+}
+
+func (s *Sender) Log() zerolog.Logger {
+	return log.With().Str("context", "fanout").Str("clientId", s.ClientId).Logger()
+}
+
+// Queues a frame, dropping the oldest queued frame if the queue is full
+func (s *Sender) SendFrame(frame *Frame) {
+	s.lock.Lock()
+	if s.options.Paused {
+		s.lock.Unlock()
+		return
+	}
+	if !s.adapter.accept(time.Now()) {
+		s.stats.SkippedFrames++
+		s.lock.Unlock()
+		return
+	}
+	if len(s.frames) >= s.maxFrames {
+		s.frames[0] = nil
+		s.frames = s.frames[1:]
+		s.stats.DroppedFrames++
+	}
+	s.frames = append(s.frames, frame)
+	s.lock.Unlock()
+
+	s.signal()
+}
+
+// Queues a message, which is sent before any queued frame and never dropped
+func (s *Sender) SendMessage(send func() error) {
+	s.lock.Lock()
+	s.messages = append(s.messages, send)
+	s.lock.Unlock()
+
+	s.signal()
+}
+
+// Changes what the client receives. Frames that are already queued are dropped when the client pauses
+func (s *Sender) SetOptions(options Options) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if options.Paused {
+		s.frames = s.frames[:0]
+	}
+	s.options = options
+	s.adapter.maxFrameRate = options.MaxFrameRate
+}
+
+func (s *Sender) Options() Options {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.options
+}
+
+func (s *Sender) Stats() Stats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stats := s.stats
+	stats.QueuedFrames = len(s.frames)
+	stats.FrameRate = s.adapter.rate
+	stats.Options = s.options
+	return stats
+}
+
+// Stops the goroutine of the sender and waits until it stopped, so that the connection can be destroyed safely afterwards.
+// Everything that is still queued is dropped. This cannot be called from the goroutine of the sender (e.g. from onFrameRate)
+func (s *Sender) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.done)
+	})
+	<-s.stopped
+}
+
+func (s *Sender) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Sender) run() {
+	defer close(s.stopped)
+
+	ticker := time.NewTicker(adaptInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.adapt()
+			continue
+		case <-s.wake:
+		}
+
+		for s.flush() {
+			// Wait for the client to catch up, messages are still sent in the meantime
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+				s.adapt()
+			case <-s.wake:
+			case <-time.After(congestionPollInterval):
+			}
+		}
+	}
+}
+
+// Adapts the frame rate of the client to how fast it receives frames
+func (s *Sender) adapt() {
+	if s.adapter.target <= 0 {
+		return
+	}
+
+	// Collecting the stats of the connection takes a while, so this happens without holding the lock
+	buffered := s.conn.BufferedAmount()
+	transport := s.conn.TransportStats()
+
+	s.lock.Lock()
+	queued := 0
+	for _, frame := range s.frames {
+		queued += len(frame.Data)
+	}
+	rate, changed := s.adapter.adapt(time.Now(), buffered, queued, transport)
+	s.lock.Unlock()
+
+	if changed && s.onFrameRate != nil {
+		s.onFrameRate(rate)
+	}
+}
+
+// Sends everything that is queued, returns true if frames are left because the client is congested
+func (s *Sender) flush() bool {
+	log := s.Log()
+
+	for {
+		// Stop early instead of draining the queue into a connection that is gone
+		select {
+		case <-s.done:
+			return false
+		default:
+		}
+
+		if message := s.nextMessage(); message != nil {
+			if err := message(); err != nil {
+				log.Err(err).Msg("Could not send message to client")
+			}
+			continue
+		}
+
+		if s.conn.BufferedAmount() > maxBufferedAmount {
+			return s.Stats().QueuedFrames > 0
+		}
+		frame, quality := s.nextFrame()
+		if frame == nil {
+			return false
+		}
+		data := frame.In(quality)
+		s.sentFrame(len(data))
+		if err := s.conn.SendFrame(data); err != nil {
+			log.Err(err).Msg("Could not send frame to client")
+		}
+	}
+}
+
+// Takes the oldest message from the queue, or returns nil if no message is queued
+func (s *Sender) nextMessage() func() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.messages) == 0 {
+		return nil
+	}
+	message := s.messages[0]
+	s.messages[0] = nil
+	s.messages = s.messages[1:]
+	return message
+}
+
+// Takes the oldest frame from the queue and returns it with the quality the client wants, or returns nil if no frame is queued
+func (s *Sender) nextFrame() (*Frame, string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.frames) == 0 {
+		return nil, ""
+	}
+	frame := s.frames[0]
+	s.frames[0] = nil
+	s.frames = s.frames[1:]
+	return frame, s.options.Quality
+}
+
+// Records a frame that was handed to the connection
+func (s *Sender) sentFrame(size int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.stats.SentFrames++
+	s.adapter.sent(size)
+}
@@ -0,0 +1,109 @@
+package httpserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"vu/ase/streamserver/src/auth"
+	"vu/ase/streamserver/src/state"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Maximum size of a signaling request body, SDP offers are typically a few kilobytes
+const maxBodySize = 1 << 20
+
+// Reads the body of a car request and verifies its signature. Returns the body so that it can be parsed by the caller
+func authenticateCar(r *http.Request, server *state.ServerState) ([]byte, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxBodySize))
+	if err != nil {
+		return nil, err
+	}
+
+	// Authentication is disabled when no key is configured
+	if len(server.CarKey) == 0 {
+		return body, nil
+	}
+
+	err = auth.VerifyCarRequest(server.CarKey, r.Header.Get("Authorization"), body, time.Now(), server.Config.Auth.CarRequestSkew)
+	if err == nil {
+		return body, nil
+	}
+
+	log.Warn().Err(err).Str("endpoint", r.URL.Path).Str("remoteAddr", r.RemoteAddr).Msg("Rejected unauthenticated car request")
+	if errors.Is(err, auth.ErrMissingCredentials) {
+		return nil, &StatusError{Status: http.StatusUnauthorized, Err: err}
+	}
+	return nil, &StatusError{Status: http.StatusForbidden, Err: err}
+}
+
+// Verifies the token of a car WHIP request and returns its claims. Without a car key, the car id is taken from the id query parameter
+func authenticateCarToken(r *http.Request, server *state.ServerState) (*auth.CarClaims, error) {
+	if len(server.CarKey) == 0 {
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			return nil, &StatusError{Status: http.StatusBadRequest, Err: fmt.Errorf("Missing car id, add it as the id query parameter")}
+		}
+		return &auth.CarClaims{Subject: id}, nil
+	}
+
+	claims, err := auth.VerifyCarToken(server.CarKey, r.Header.Get("Authorization"), time.Now())
+	if err == nil {
+		return claims, nil
+	}
+
+	log.Warn().Err(err).Str("endpoint", r.URL.Path).Str("remoteAddr", r.RemoteAddr).Msg("Rejected unauthenticated car request")
+	if errors.Is(err, auth.ErrMissingCredentials) {
+		return nil, &StatusError{Status: http.StatusUnauthorized, Err: err}
+	}
+	return nil, &StatusError{Status: http.StatusForbidden, Err: err}
+}
+
+// Verifies the token of a client request and returns its claims
+func authenticateClient(r *http.Request, server *state.ServerState) (*auth.ClientClaims, error) {
+	// Authentication is disabled when no key is configured, everyone may control the car then
+	if len(server.ClientKey) == 0 {
+		return &auth.ClientClaims{Role: auth.RoleController}, nil
+	}
+
+	claims, err := auth.VerifyClientToken(server.ClientKey, r.Header.Get("Authorization"), time.Now())
+	if err == nil {
+		return claims, nil
+	}
+
+	log.Warn().Err(err).Str("endpoint", r.URL.Path).Str("remoteAddr", r.RemoteAddr).Msg("Rejected unauthenticated client request")
+	if errors.Is(err, auth.ErrMissingCredentials) {
+		return nil, &StatusError{Status: http.StatusUnauthorized, Err: err}
+	}
+	return nil, &StatusError{Status: http.StatusForbidden, Err: err}
+}
+
+// Makes sure that a client token can be used in the room with the given id
+func authorizeClientRoom(r *http.Request, claims *auth.ClientClaims, roomId string) error {
+	return authorizeRoom(r, claims.Room, roomId)
+}
+
+// Makes sure that a token that is restricted to tokenRoom (if not empty) can be used in the room with the given id
+func authorizeRoom(r *http.Request, tokenRoom string, roomId string) error {
+	if tokenRoom == "" || tokenRoom == roomId {
+		return nil
+	}
+
+	err := fmt.Errorf("%w: token is not valid for room %s", auth.ErrInvalidCredentials, roomId)
+	log.Warn().Err(err).Str("endpoint", r.URL.Path).Str("remoteAddr", r.RemoteAddr).Msg("Rejected request for other room")
+	return &StatusError{Status: http.StatusForbidden, Err: err}
+}
+
+// Makes sure that a client is an admin, for the endpoints that manage the server instead of a connection
+func authorizeAdmin(r *http.Request, claims *auth.ClientClaims) error {
+	if claims.Role.IsAdmin() {
+		return nil
+	}
+
+	err := fmt.Errorf("%w: only admins can use this endpoint", auth.ErrInvalidCredentials)
+	log.Warn().Err(err).Str("endpoint", r.URL.Path).Str("remoteAddr", r.RemoteAddr).Msg("Rejected request of client that is not an admin")
+	return &StatusError{Status: http.StatusForbidden, Err: err}
+}
@@ -0,0 +1,39 @@
+package httpserver
+
+import (
+	"net/http"
+	"slices"
+)
+
+// The origins that may use the endpoints from a browser, "*" allows all origins
+var corsOrigins = []string{"*"}
+
+// Sets the CORS headers for the origin of the request. Returns true if the request was a preflight request that has been answered
+func handleCors(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if slices.Contains(corsOrigins, "*") {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else if origin != "" && slices.Contains(corsOrigins, origin) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+	}
+
+	// WHIP/WHEP clients need to read the resource URL and ICE servers from the response headers
+	w.Header().Set("Access-Control-Expose-Headers", "Location, Link")
+
+	if r.Method != http.MethodOptions {
+		return false
+	}
+
+	// Browsers send a preflight request before sending the Authorization header
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// Returns true if the origin of a WebSocket upgrade request may use the endpoints (non-browser peers do not send an origin)
+func allowedOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	return origin == "" || slices.Contains(corsOrigins, "*") || slices.Contains(corsOrigins, origin)
+}
@@ -8,12 +8,14 @@ package httpserver
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/rs/zerolog/log"
 
 	"net/http"
+	livestreamconfig "vu/ase/streamserver/src/config"
 	"vu/ase/streamserver/src/events"
 	"vu/ase/streamserver/src/state"
 
@@ -25,6 +27,20 @@ type EndpointError struct {
 	Message string `json:"message"`
 }
 
+// Can be returned by endpoint handlers to respond with a specific HTTP status code instead of 500
+type StatusError struct {
+	Status int
+	Err    error
+}
+
+func (e *StatusError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
 // Explains usage of an HTTP endpoint. Returns true if the request was a GET request.
 func explainPostUsage(w http.ResponseWriter, r *http.Request, usage string) bool {
 	if r.Method != "POST" {
@@ -39,70 +55,220 @@ func explainPostUsage(w http.ResponseWriter, r *http.Request, usage string) bool
 // Template function for creating an HTTP endpoint with error handling and CORS headers
 func JSONEndpoint(usage string, handler func(w http.ResponseWriter, r *http.Request) ([]byte, error)) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if handleCors(w, r) {
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
 
 		if explainPostUsage(w, r, usage) {
 			return
 		}
 
-		if payload, err := handler(w, r); err != nil {
-			// Log the error to the console and send a HTTP response
-			log.Err(err).Str("endpoint", r.URL.Path).Str("method", r.Method).Msg("Could not process request")
-			w.WriteHeader(http.StatusInternalServerError)
-
-			// Encode error as JSON
-			errorObj := EndpointError{
-				Error:   true,
-				Message: err.Error(),
-			}
-			payload, err := json.Marshal(errorObj)
-			if err != nil {
-				log.Err(err).Str("endpoint", r.URL.Path).Str("method", r.Method).Msg("Could not encode error as JSON")
-			} else {
-				_, _ = w.Write(payload)
-			}
+		payload, err := handler(w, r)
+		writeJSONResponse(w, r, payload, err, http.StatusCreated)
+	}
+}
+
+// Template function for creating an HTTP endpoint that only answers GET requests, with error handling and CORS headers
+func JSONGetEndpoint(handler func(w http.ResponseWriter, r *http.Request) ([]byte, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if handleCors(w, r) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method != "GET" {
+			writeJSONResponse(w, r, nil, &StatusError{Status: http.StatusMethodNotAllowed, Err: fmt.Errorf("To use this endpoint, send a GET request")}, http.StatusOK)
+			return
+		}
+
+		payload, err := handler(w, r)
+		writeJSONResponse(w, r, payload, err, http.StatusOK)
+	}
+}
+
+// Sends the payload of a handler, or its error encoded as JSON
+func writeJSONResponse(w http.ResponseWriter, r *http.Request, payload []byte, err error, successStatus int) {
+	if err != nil {
+		// Log the error to the console and send a HTTP response
+		log.Err(err).Str("endpoint", r.URL.Path).Str("method", r.Method).Msg("Could not process request")
+		status := http.StatusInternalServerError
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) {
+			status = statusErr.Status
+		}
+		w.WriteHeader(status)
+
+		// Encode error as JSON
+		errorObj := EndpointError{
+			Error:   true,
+			Message: err.Error(),
+		}
+		payload, err := json.Marshal(errorObj)
+		if err != nil {
+			log.Err(err).Str("endpoint", r.URL.Path).Str("method", r.Method).Msg("Could not encode error as JSON")
 		} else {
-			// Let the HTTP client know that the request was successful
-			w.WriteHeader(http.StatusCreated)
 			_, _ = w.Write(payload)
 		}
+	} else {
+		// Let the HTTP client know that the request was successful
+		w.WriteHeader(successStatus)
+		_, _ = w.Write(payload)
 	}
 }
 
-// Configure the HTTP server to listen for incoming connections on the configured endpoints
-func Serve(serverAddress string, state *state.ServerState) error {
+// Used to find the id of the room that a signaling request is meant for
+type roomResolver func(r *http.Request) string
 
-	//
-	// Client endpoints
-	//
+// Resolves every request to the default room
+func defaultRoom(r *http.Request) string {
+	return livestreamconfig.DefaultRoomId
+}
+
+// Resolves requests to the room with the id in the request path
+func roomFromPath(r *http.Request) string {
+	return r.PathValue("id")
+}
 
+// Returns the room with the given id, without creating it
+func existingRoom(server *state.ServerState, id string) (*state.Room, error) {
+	room := server.GetRoom(id)
+	if room == nil {
+		return nil, &StatusError{Status: http.StatusNotFound, Err: fmt.Errorf("Room with id %s does not exist", id)}
+	}
+	return room, nil
+}
+
+// Configure the HTTP server to listen for incoming connections on the configured endpoints
+func Serve(serverAddress string, state *state.ServerState) error {
 	// To show a welcome message when someone connects to the base URL through the browser
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "index.html")
 	})
 
+	// The endpoints that are not scoped to a room use the default room
+	registerSignalingEndpoints("", state, defaultRoom)
+	// Room endpoints, a room is created when the first car or client sends its SDP offer and removed when everyone left
+	registerSignalingEndpoints("/rooms/{id}", state, roomFromPath)
+
+	// Start HTTP server to accept incoming connections
+	log.Info().Msgf("ForwardingServer HTTP listener active on '%s'", serverAddress)
+
+	// Only allow the configured origins to use the endpoints from a browser
+	corsOrigins = state.Config.Server.CorsOrigins
+
+	server := &http.Server{
+		Addr:         serverAddress,
+		ReadTimeout:  state.Config.Server.ReadTimeout,
+		WriteTimeout: state.Config.Server.WriteTimeout,
+		IdleTimeout:  state.Config.Server.IdleTimeout,
+	}
+	err := server.ListenAndServe()
+	if err != nil {
+		return fmt.Errorf("Cannot start HTTP server: %v", err)
+	}
+	return err
+}
+
+// Register the client and car signaling endpoints under the given path prefix, for the room that the resolver returns
+func registerSignalingEndpoints(prefix string, server *state.ServerState, roomId roomResolver) {
+	//
+	// Client endpoints
+	//
+
 	// To retrieve an SDP offer (and send back an SDP answer)
-	http.HandleFunc("/client/sdp", JSONEndpoint("[💻 CLIENT ONLY]: Send your SDP offer as a JSON object", func(w http.ResponseWriter, r *http.Request) ([]byte, error) {
-		// Parse offer from request body
-		request := rtc.RequestSDP{}
+	http.HandleFunc(prefix+"/client/sdp", JSONEndpoint("[💻 CLIENT ONLY]: Send your SDP offer as a JSON object, optionally with the ids of the cars to subscribe to (carIds) and trickle to use trickle ICE. Authenticate with a Bearer token", func(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+		// The token of the client determines what it is allowed to do
+		claims, err := authenticateClient(r, server)
+		if err != nil {
+			return nil, err
+		}
+
+		id := roomId(r)
+		if err := authorizeClientRoom(r, claims, id); err != nil {
+			return nil, err
+		}
+
+		// Parse offer (and optional car subscription) from request body
+		request := events.ClientRequestSDP{}
 		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 			return nil, err
 		}
 
+		// The room is only created once the offer is known to be valid
+		room, err := server.AcquireRoom(id)
+		if err != nil {
+			return nil, err
+		}
+		defer server.ReleaseRoom(room)
+
 		// Process offer
-		return events.OnClientSDPReceived(request, state)
+		return events.OnClientSDPReceived(request, claims.Role, room)
 	}))
 
 	// To retrieve an ICE candidate (and send back an ICE candidate)
-	http.HandleFunc("/client/ice", JSONEndpoint("[💻 CLIENT ONLY]: Send your ICE candidate as a JSON object", func(w http.ResponseWriter, r *http.Request) ([]byte, error) {
-		// Parse ICE from request body
-		request := rtc.RequestICE{}
+	http.HandleFunc(prefix+"/client/ice", JSONEndpoint("[💻 CLIENT ONLY]: Send your ICE candidate as a JSON object, with the session secret from the SDP answer (secret). Authenticate with a Bearer token", func(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+		claims, err := authenticateClient(r, server)
+		if err != nil {
+			return nil, err
+		}
+
+		id := roomId(r)
+		if err := authorizeClientRoom(r, claims, id); err != nil {
+			return nil, err
+		}
+		room, err := existingRoom(server, id)
+		if err != nil {
+			return nil, err
+		}
+
+		// Parse ICE (and the session secret) from request body
+		request := events.ClientRequestICE{}
 		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 			return nil, err
 		}
 
-		return events.OnClientICEReceived(request, state)
+		return events.OnClientICEReceived(request, room)
+	}))
+
+	// To retrieve new local ICE candidates when using trickle ICE (long-polling)
+	http.HandleFunc(prefix+"/client/candidates", JSONEndpoint("[💻 CLIENT ONLY]: Send your session id, session secret and the number of candidates received so far as a JSON object", func(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+		claims, err := authenticateClient(r, server)
+		if err != nil {
+			return nil, err
+		}
+
+		id := roomId(r)
+		if err := authorizeClientRoom(r, claims, id); err != nil {
+			return nil, err
+		}
+		room, err := existingRoom(server, id)
+		if err != nil {
+			return nil, err
+		}
+
+		request := events.RequestCandidates{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			return nil, err
+		}
+
+		extendWriteDeadline(w, events.CandidatesPollTimeout)
+		return events.OnCandidatesRequested(r.Context(), request, false, room)
+	}))
+
+	// To retrieve the ICE servers (with credentials) that the client should use for its peer connection
+	http.HandleFunc(prefix+"/client/ice-servers", JSONGetEndpoint(func(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+		claims, err := authenticateClient(r, server)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := authorizeClientRoom(r, claims, roomId(r)); err != nil {
+			return nil, err
+		}
+
+		// The ICE servers are the same for every room, so clients can ask for them before the room exists
+		return json.Marshal(server.PeerConnectionConfig().ICEServers)
 	}))
 
 	//
@@ -110,36 +276,88 @@ func Serve(serverAddress string, state *state.ServerState) error {
 	//
 
 	// To retrieve an SDP offer (and send back an SDP answer)
-	http.HandleFunc("/car/sdp", JSONEndpoint("[🚗 CAR ONLY]: Send your SDP offer as a JSON object", func(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	http.HandleFunc(prefix+"/car/sdp", JSONEndpoint("[🚗 CAR ONLY]: Send your SDP offer as a JSON object (set trickle to use trickle ICE), signed in the Authorization header", func(w http.ResponseWriter, r *http.Request) ([]byte, error) {
 		// Record the timestamp at which this request was received
 		receivedAt := time.Now().UnixMilli()
 
+		// Only registered cars may send offers
+		body, err := authenticateCar(r, server)
+		if err != nil {
+			return nil, err
+		}
+
 		// Parse offer from request body
-		request := rtc.RequestSDP{}
-		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		request := events.CarRequestSDP{}
+		if err := json.Unmarshal(body, &request); err != nil {
+			return nil, err
+		}
+
+		room, err := server.AcquireRoom(roomId(r))
+		if err != nil {
 			return nil, err
 		}
+		defer server.ReleaseRoom(room)
 
-		return events.OnCarSDPReceived(request, receivedAt, state)
+		return events.OnCarSDPReceived(request, receivedAt, room)
 	}))
 
 	// To retrieve an ICE candidate (and send back an ICE candidate)
-	http.HandleFunc("/car/ice", JSONEndpoint("[🚗 CAR ONLY]: Send your ICE candidate as a JSON object", func(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	http.HandleFunc(prefix+"/car/ice", JSONEndpoint("[🚗 CAR ONLY]: Send your ICE candidate as a JSON object, signed in the Authorization header", func(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+		// Only registered cars may send ICE candidates
+		body, err := authenticateCar(r, server)
+		if err != nil {
+			return nil, err
+		}
+
+		room, err := existingRoom(server, roomId(r))
+		if err != nil {
+			return nil, err
+		}
+
 		// Parse ICE from request body
 		request := rtc.RequestICE{}
-		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		if err := json.Unmarshal(body, &request); err != nil {
 			return nil, err
 		}
 
-		return events.OnCarICEReceived(request, state)
+		return events.OnCarICEReceived(request, room)
 	}))
 
-	// Start HTTP server to accept incoming connections
-	log.Info().Msgf("ForwardingServer HTTP listener active on '%s'", serverAddress)
+	// To retrieve new local ICE candidates when using trickle ICE (long-polling)
+	http.HandleFunc(prefix+"/car/candidates", JSONEndpoint("[🚗 CAR ONLY]: Send your id, the number of candidates received so far and a timestamp as a JSON object, signed in the Authorization header", func(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+		body, err := authenticateCar(r, server)
+		if err != nil {
+			return nil, err
+		}
 
-	err := http.ListenAndServe(serverAddress, nil)
-	if err != nil {
-		return fmt.Errorf("Cannot start HTTP server: %v", err)
-	}
-	return err
+		room, err := existingRoom(server, roomId(r))
+		if err != nil {
+			return nil, err
+		}
+
+		request := events.RequestCandidates{}
+		if err := json.Unmarshal(body, &request); err != nil {
+			return nil, err
+		}
+
+		extendWriteDeadline(w, events.CandidatesPollTimeout)
+		return events.OnCandidatesRequested(r.Context(), request, true, room)
+	}))
+
+	// WHIP (car) and WHEP (client) endpoints for standard tools
+	registerWHIPEndpoints(prefix, server, roomId)
+
+	// WebSocket signaling for both cars and clients
+	registerWebSocketEndpoint(prefix, server, roomId)
+
+	// Recordings of the room, for admins
+	registerRecordingEndpoints(prefix, server, roomId)
+
+	// Replays of the recordings as synthetic cars, for admins
+	registerReplayEndpoints(prefix, server, roomId)
+}
+
+// Long-polling requests can take longer than the configured write timeout allows
+func extendWriteDeadline(w http.ResponseWriter, wait time.Duration) {
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(wait + 5*time.Second))
 }
@@ -0,0 +1,122 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"vu/ase/streamserver/src/events"
+	"vu/ase/streamserver/src/recording"
+	"vu/ase/streamserver/src/state"
+)
+
+//
+// Admins can record rooms to disk and download the recordings afterwards. Recordings can also be started and stopped
+// with server messages on the meta channel, see the recording package for the format of the files.
+//
+
+const recordingPathValueName = "name"
+
+// Register the recording endpoints under the given path prefix
+func registerRecordingEndpoints(prefix string, server *state.ServerState, roomId roomResolver) {
+	// Resolves the room of a recording request, after making sure that the request comes from an admin.
+	// Recordings outlive their rooms, so reading them acquires the room if needed, the caller needs to release it then
+	adminRoom := func(r *http.Request, acquire bool) (*state.Room, error) {
+		claims, err := authenticateClient(r, server)
+		if err != nil {
+			return nil, err
+		}
+		if err := authorizeAdmin(r, claims); err != nil {
+			return nil, err
+		}
+
+		id := roomId(r)
+		if err := authorizeClientRoom(r, claims, id); err != nil {
+			return nil, err
+		}
+		if acquire {
+			return server.AcquireRoom(id)
+		}
+		return existingRoom(server, id)
+	}
+
+	// To list the recordings of the room
+	http.HandleFunc(prefix+"/recordings", JSONGetEndpoint(func(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+		room, err := adminRoom(r, true)
+		if err != nil {
+			return nil, err
+		}
+		defer server.ReleaseRoom(room)
+
+		recordings, err := events.OnRecordingsRequested(room)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(recordings)
+	}))
+
+	// To start recording the room
+	http.HandleFunc(prefix+"/recordings/start", JSONEndpoint("[💻 ADMIN ONLY]: Send an empty request to start recording the room. Authenticate with a Bearer token", func(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+		room, err := adminRoom(r, false)
+		if err != nil {
+			return nil, err
+		}
+
+		info, err := events.OnRecordingStart(room)
+		if err != nil {
+			return nil, &StatusError{Status: http.StatusConflict, Err: err}
+		}
+		return json.Marshal(info)
+	}))
+
+	// To stop recording the room
+	http.HandleFunc(prefix+"/recordings/stop", JSONEndpoint("[💻 ADMIN ONLY]: Send an empty request to stop recording the room. Authenticate with a Bearer token", func(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+		room, err := adminRoom(r, false)
+		if err != nil {
+			return nil, err
+		}
+
+		info, err := events.OnRecordingStop(room)
+		if err != nil {
+			return nil, &StatusError{Status: http.StatusConflict, Err: err}
+		}
+		return json.Marshal(info)
+	}))
+
+	// To download a recording (recordings that are still active can be downloaded as far as they were written)
+	http.HandleFunc(prefix+"/recordings/{"+recordingPathValueName+"}", func(w http.ResponseWriter, r *http.Request) {
+		if handleCors(w, r) {
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			w.Header().Set("Content-Type", "application/json")
+			writeJSONResponse(w, r, nil, &StatusError{Status: http.StatusMethodNotAllowed, Err: fmt.Errorf("To use this endpoint, send a GET request")}, http.StatusOK)
+			return
+		}
+
+		room, err := adminRoom(r, true)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			writeJSONResponse(w, r, nil, err, http.StatusOK)
+			return
+		}
+		defer server.ReleaseRoom(room)
+
+		name := r.PathValue(recordingPathValueName)
+		path, err := recording.Path(room.RecordingDirectory(), name)
+		if err == nil {
+			_, err = os.Stat(path)
+		}
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			writeJSONResponse(w, r, nil, &StatusError{Status: http.StatusNotFound, Err: fmt.Errorf("Recording '%s' does not exist", name)}, http.StatusOK)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s-%s\"", room.Id, name))
+		http.ServeFile(w, r, path)
+	})
+}
@@ -0,0 +1,99 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"vu/ase/streamserver/src/events"
+	"vu/ase/streamserver/src/state"
+)
+
+//
+// Admins can replay the recordings of a room as synthetic cars. Clients that are routed to a replay
+// control its playback with server messages on the meta channel.
+//
+
+// Register the replay endpoints under the given path prefix
+func registerReplayEndpoints(prefix string, server *state.ServerState, roomId roomResolver) {
+	// Resolves the id of the room of a replay request, after making sure that the request comes from an admin
+	adminRoomId := func(r *http.Request) (string, error) {
+		claims, err := authenticateClient(r, server)
+		if err != nil {
+			return "", err
+		}
+		if err := authorizeAdmin(r, claims); err != nil {
+			return "", err
+		}
+
+		id := roomId(r)
+		if err := authorizeClientRoom(r, claims, id); err != nil {
+			return "", err
+		}
+		return id, nil
+	}
+
+	// To list the replays of the room
+	http.HandleFunc(prefix+"/replays", JSONGetEndpoint(func(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+		id, err := adminRoomId(r)
+		if err != nil {
+			return nil, err
+		}
+
+		// The recordings outlive their rooms, so they can be listed for rooms that are empty
+		room, err := server.AcquireRoom(id)
+		if err != nil {
+			return nil, err
+		}
+		defer server.ReleaseRoom(room)
+
+		return json.Marshal(events.OnReplaysRequested(room))
+	}))
+
+	// To start replaying one of the recordings of the room
+	http.HandleFunc(prefix+"/replays/start", JSONEndpoint("[💻 ADMIN ONLY]: Send the name of the recording as a JSON object, optionally with the recorded car to replay (carId), the id of the synthetic car (id) and loop. Authenticate with a Bearer token", func(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+		id, err := adminRoomId(r)
+		if err != nil {
+			return nil, err
+		}
+
+		request := events.ReplayRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			return nil, &StatusError{Status: http.StatusBadRequest, Err: err}
+		}
+
+		room, err := server.AcquireRoom(id)
+		if err != nil {
+			return nil, err
+		}
+		defer server.ReleaseRoom(room)
+
+		state, err := events.OnReplayStart(request, room)
+		if err != nil {
+			return nil, &StatusError{Status: http.StatusBadRequest, Err: err}
+		}
+		return json.Marshal(state)
+	}))
+
+	// To stop a replay
+	http.HandleFunc(prefix+"/replays/stop", JSONEndpoint("[💻 ADMIN ONLY]: Send the id of the synthetic car as a JSON object. Authenticate with a Bearer token", func(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+		id, err := adminRoomId(r)
+		if err != nil {
+			return nil, err
+		}
+		room, err := existingRoom(server, id)
+		if err != nil {
+			return nil, err
+		}
+
+		request := events.StopReplayRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			return nil, &StatusError{Status: http.StatusBadRequest, Err: err}
+		}
+
+		state, err := events.OnReplayStop(request, room)
+		if err != nil {
+			return nil, &StatusError{Status: http.StatusNotFound, Err: err}
+		}
+		return json.Marshal(state)
+	}))
+}
@@ -0,0 +1,173 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"vu/ase/streamserver/src/auth"
+	"vu/ase/streamserver/src/events"
+	"vu/ase/streamserver/src/signaling"
+	"vu/ase/streamserver/src/state"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+//
+// The /ws endpoint upgrades to a WebSocket over which a car (peer=car) or client (default) negotiates its connection,
+// see the signaling package for the protocol. Browsers cannot set the Authorization header on a WebSocket,
+// so the token can also be sent in the token query parameter.
+//
+
+// Only text messages are used for signaling
+var errUnsupportedMessage = fmt.Errorf("Signaling messages need to be sent as JSON text messages")
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: allowedOrigin,
+}
+
+// Register the WebSocket signaling endpoint under the given path prefix
+func registerWebSocketEndpoint(prefix string, server *state.ServerState, roomId roomResolver) {
+	http.HandleFunc(prefix+"/ws", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if token := query.Get("token"); token != "" && r.Header.Get("Authorization") == "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		// Authenticate before upgrading, so that errors can be reported with a proper status code
+		var carId string
+		var role auth.Role
+		var room *state.Room
+		var err error
+		if query.Get("peer") == "car" {
+			carId, room, err = authenticateWebSocketCar(r, server, roomId)
+		} else {
+			role, room, err = authenticateWebSocketClient(r, server, roomId)
+		}
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			writeJSONResponse(w, r, nil, err, http.StatusOK)
+			return
+		}
+
+		// The room is kept while the session is open, even before the peer sent its offer
+		defer server.ReleaseRoom(room)
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// The upgrader already responded with an error
+			log.Err(err).Str("endpoint", r.URL.Path).Msg("Could not upgrade to WebSocket")
+			return
+		}
+
+		serveWebSocket(signaling.NewSession(conn, carId, role), conn, room)
+	})
+}
+
+// Authenticates a car and acquires its room, which needs to be released by the caller
+func authenticateWebSocketCar(r *http.Request, server *state.ServerState, roomId roomResolver) (string, *state.Room, error) {
+	claims, err := authenticateCarToken(r, server)
+	if err != nil {
+		return "", nil, err
+	}
+
+	id := roomId(r)
+	if err := authorizeRoom(r, claims.Room, id); err != nil {
+		return "", nil, err
+	}
+	room, err := server.AcquireRoom(id)
+	if err != nil {
+		return "", nil, err
+	}
+	return claims.Subject, room, nil
+}
+
+// Authenticates a client and acquires its room, which needs to be released by the caller
+func authenticateWebSocketClient(r *http.Request, server *state.ServerState, roomId roomResolver) (auth.Role, *state.Room, error) {
+	claims, err := authenticateClient(r, server)
+	if err != nil {
+		return "", nil, err
+	}
+
+	id := roomId(r)
+	if err := authorizeClientRoom(r, claims, id); err != nil {
+		return "", nil, err
+	}
+	room, err := server.AcquireRoom(id)
+	if err != nil {
+		return "", nil, err
+	}
+	return claims.Role, room, nil
+}
+
+// Reads signaling messages until the WebSocket is closed, while keeping the connection alive with pings
+func serveWebSocket(session *signaling.Session, conn *websocket.Conn, room *state.Room) {
+	logger := room.Log().With().Str("remoteAddr", conn.RemoteAddr().String())
+	if session.IsCar() {
+		logger = logger.Str("carId", session.CarId)
+	}
+	log := logger.Logger()
+	log.Info().Msg("WebSocket signaling session opened")
+
+	defer func() {
+		events.OnSignalingClosed(session, room)
+		_ = session.Close()
+		log.Info().Msg("WebSocket signaling session closed")
+	}()
+
+	conn.SetReadLimit(maxBodySize)
+	_ = conn.SetReadDeadline(time.Now().Add(signaling.PongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(signaling.PongTimeout))
+	})
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(signaling.PingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := session.Ping(); err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Warn().Err(err).Msg("WebSocket closed unexpectedly")
+			}
+			return
+		}
+		receivedAt := time.Now().UnixMilli()
+
+		msg := signaling.Message{}
+		if messageType != websocket.TextMessage {
+			err = errUnsupportedMessage
+		} else if err = json.Unmarshal(data, &msg); err == nil {
+			err = events.OnSignalingMessage(session, msg, receivedAt, room)
+		}
+
+		if err != nil {
+			log.Err(err).Str("type", msg.Type).Msg("Could not process signaling message")
+
+			// Report the error to the peer
+			sendErr := session.Send(signaling.Message{
+				Type:    signaling.TypeError,
+				Message: err.Error(),
+			})
+			if sendErr != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package httpserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"vu/ase/streamserver/src/auth"
+	"vu/ase/streamserver/src/events"
+	"vu/ase/streamserver/src/state"
+)
+
+//
+// WHIP/WHEP endpoints (RFC 9725 and the WHEP draft), so that standard tools can connect without our JSON signaling.
+// Cars ingest through /whip, clients (viewers) egress through /whep. Offers are POSTed as application/sdp and the created
+// session is addressed by the resource URL in the Location header, which accepts PATCH (trickle ICE) and DELETE (teardown).
+//
+
+const (
+	sdpContentType      = "application/sdp"
+	sdpFragContentType  = "application/trickle-ice-sdpfrag"
+	resourcePathValueId = "resourceId"
+)
+
+// Handles an offer and returns the answer with the resource id of the new session. The handler reads the offer
+// with readOffer once it authenticated the peer, so that unauthenticated requests are not read
+type offerHandler func(r *http.Request) (*events.ResourceAnswer, error)
+
+// Handles a PATCH or DELETE request for the resource with the given id. PATCH requests carry an SDP fragment,
+// which the handler reads with readFragment once it authenticated the peer
+type resourceHandler func(r *http.Request, resourceId string) error
+
+// Template function for creating a WHIP/WHEP endpoint that accepts SDP offers
+func SDPEndpoint(server *state.ServerState, handler offerHandler) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if handleCors(w, r) {
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST, OPTIONS")
+			writeJSONResponse(w, r, nil, &StatusError{Status: http.StatusMethodNotAllowed, Err: fmt.Errorf("To use this endpoint, POST your SDP offer as %s", sdpContentType)}, http.StatusCreated)
+			return
+		}
+
+		answer, err := handler(r)
+		if err != nil {
+			writeJSONResponse(w, r, nil, err, http.StatusCreated)
+			return
+		}
+
+		w.Header().Set("Content-Type", sdpContentType)
+		w.Header().Set("Location", path.Join(r.URL.Path, answer.ResourceId))
+		for _, link := range iceServerLinks(server) {
+			w.Header().Add("Link", link)
+		}
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(answer.SDP))
+	}
+}
+
+// Template function for creating the endpoint of WHIP/WHEP resources (the sessions created by SDPEndpoint)
+func SDPResourceEndpoint(handler resourceHandler) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if handleCors(w, r) {
+			return
+		}
+
+		resourceId := r.PathValue(resourcePathValueId)
+
+		var err error
+		switch r.Method {
+		case http.MethodPatch, http.MethodDelete:
+			err = handler(r, resourceId)
+		default:
+			w.Header().Set("Allow", "PATCH, DELETE, OPTIONS")
+			err = &StatusError{Status: http.StatusMethodNotAllowed, Err: fmt.Errorf("To use this endpoint, send a PATCH (trickle ICE) or DELETE (end session) request")}
+		}
+
+		if errors.Is(err, events.ErrUnknownResource) {
+			err = &StatusError{Status: http.StatusNotFound, Err: err}
+		}
+		if err != nil {
+			writeJSONResponse(w, r, nil, err, http.StatusNoContent)
+			return
+		}
+
+		// Successful PATCH and DELETE requests have no response body
+		if r.Method == http.MethodDelete {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+// Reads the SDP offer of a request
+func readOffer(r *http.Request) (string, error) {
+	return readBody(r, sdpContentType)
+}
+
+// Reads the SDP fragment (trickled candidates) of a PATCH request
+func readFragment(r *http.Request) (string, error) {
+	return readBody(r, sdpFragContentType)
+}
+
+// Reads the body of a request after checking its content type
+func readBody(r *http.Request, contentType string) (string, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != contentType {
+		return "", &StatusError{Status: http.StatusUnsupportedMediaType, Err: fmt.Errorf("Content type needs to be %s", contentType)}
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxBodySize))
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// The ICE servers that the peer should use, as Link headers
+func iceServerLinks(s *state.ServerState) []string {
+	links := make([]string, 0)
+	for _, server := range s.PeerConnectionConfig().ICEServers {
+		for _, url := range server.URLs {
+			link := fmt.Sprintf("<%s>; rel=\"ice-server\"", url)
+			if server.Username != "" {
+				link += fmt.Sprintf("; username=%s; credential=%s; credential-type=\"password\"", quotedString(server.Username), quotedString(fmt.Sprint(server.Credential)))
+			}
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+// Formats a Link header parameter value as a quoted string (RFC 8288), so that credentials can contain any character
+func quotedString(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
+
+// Register the WHIP (car) and WHEP (client) endpoints under the given path prefix
+func registerWHIPEndpoints(prefix string, server *state.ServerState, roomId roomResolver) {
+	//
+	// Car endpoints
+	//
+
+	http.HandleFunc(prefix+"/whip", SDPEndpoint(server, func(r *http.Request) (*events.ResourceAnswer, error) {
+		// Record the timestamp at which this request was received
+		receivedAt := time.Now().UnixMilli()
+
+		claims, err := authenticateCarToken(r, server)
+		if err != nil {
+			return nil, err
+		}
+
+		id := roomId(r)
+		if err := authorizeRoom(r, claims.Room, id); err != nil {
+			return nil, err
+		}
+		offer, err := readOffer(r)
+		if err != nil {
+			return nil, err
+		}
+
+		room, err := server.AcquireRoom(id)
+		if err != nil {
+			return nil, err
+		}
+		defer server.ReleaseRoom(room)
+
+		return events.OnCarWHIPOffer(claims.Subject, offer, receivedAt, room)
+	}))
+
+	http.HandleFunc(prefix+"/whip/{"+resourcePathValueId+"}", SDPResourceEndpoint(func(r *http.Request, resourceId string) error {
+		claims, err := authenticateCarToken(r, server)
+		if err != nil {
+			return err
+		}
+
+		id := roomId(r)
+		if err := authorizeRoom(r, claims.Room, id); err != nil {
+			return err
+		}
+		room, err := existingRoom(server, id)
+		if err != nil {
+			return err
+		}
+
+		// A car can only manage its own session
+		carId, err := events.ResourcePeer(resourceId, true, room)
+		if err != nil {
+			return err
+		}
+		if carId != claims.Subject {
+			return &StatusError{Status: http.StatusForbidden, Err: fmt.Errorf("%w: resource belongs to another car", auth.ErrInvalidCredentials)}
+		}
+
+		if r.Method == http.MethodDelete {
+			return events.OnResourceDeleted(resourceId, true, room)
+		}
+		fragment, err := readFragment(r)
+		if err != nil {
+			return err
+		}
+		return events.OnResourceCandidatesReceived(resourceId, true, fragment, room)
+	}))
+
+	//
+	// Client endpoints
+	//
+
+	http.HandleFunc(prefix+"/whep", SDPEndpoint(server, func(r *http.Request) (*events.ResourceAnswer, error) {
+		claims, err := authenticateClient(r, server)
+		if err != nil {
+			return nil, err
+		}
+
+		id := roomId(r)
+		if err := authorizeClientRoom(r, claims, id); err != nil {
+			return nil, err
+		}
+		offer, err := readOffer(r)
+		if err != nil {
+			return nil, err
+		}
+
+		room, err := server.AcquireRoom(id)
+		if err != nil {
+			return nil, err
+		}
+		defer server.ReleaseRoom(room)
+
+		// WHEP players cannot send a label or car subscription in their offer, so these can be set in the query
+		query := r.URL.Query()
+		label := query.Get("label")
+		if label == "" {
+			label = claims.Subject
+		}
+		carIds := make([]string, 0)
+		for _, carId := range strings.Split(query.Get("carIds"), ",") {
+			if carId = strings.TrimSpace(carId); carId != "" {
+				carIds = append(carIds, carId)
+			}
+		}
+
+		return events.OnClientWHEPOffer(label, carIds, offer, claims.Role, room)
+	}))
+
+	http.HandleFunc(prefix+"/whep/{"+resourcePathValueId+"}", SDPResourceEndpoint(func(r *http.Request, resourceId string) error {
+		claims, err := authenticateClient(r, server)
+		if err != nil {
+			return err
+		}
+
+		id := roomId(r)
+		if err := authorizeClientRoom(r, claims, id); err != nil {
+			return err
+		}
+		room, err := existingRoom(server, id)
+		if err != nil {
+			return err
+		}
+
+		// The resource id is only known to the client that created the session
+		if r.Method == http.MethodDelete {
+			return events.OnResourceDeleted(resourceId, false, room)
+		}
+		fragment, err := readFragment(r)
+		if err != nil {
+			return err
+		}
+		return events.OnResourceCandidatesReceived(resourceId, false, fragment, room)
+	}))
+}
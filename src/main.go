@@ -3,34 +3,58 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
 
 	livestreamconfig "vu/ase/streamserver/src/config"
+	"vu/ase/streamserver/src/events"
 	"vu/ase/streamserver/src/httpserver"
+	"vu/ase/streamserver/src/simulator"
 	"vu/ase/streamserver/src/state"
-
-	rtc "github.com/VU-ASE/roverrtc/src"
+	"vu/ase/streamserver/src/turnserver"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
-func run(serverAddress string) error {
-	state, err := state.NewServerState()
+func run(config *livestreamconfig.Config, serverAddress string, replayPath string, replayLoop bool) error {
+	// Start the embedded TURN server and advertise it to all peers
+	if config.Turn.Enabled {
+		turnServer, err := turnserver.Start(config.Turn, config.WebRTC.NatIps)
+		if err != nil {
+			return err
+		}
+		defer turnServer.Close()
+
+		config.WebRTC.IceServers = append(config.WebRTC.IceServers, turnServer.ICEServer())
+	}
+
+	state, err := state.NewServerState(config)
 	if err != nil {
 		return fmt.Errorf("Could not create server state: %v", err)
 	}
 
-	// Create a map to hold all active connections
-	connectedPeers := rtc.NewRTCMap()
 	// Clean up connections when the server is shut down
 	defer state.Destroy()
 
-	// Global server state
-	state.ConnectedPeers = connectedPeers
+	// Serve a recording as a synthetic car in the default room
+	if replayPath != "" {
+		if _, err := events.StartReplayFile(replayPath, replayLoop, state.DefaultRoom()); err != nil {
+			return fmt.Errorf("Could not start replay: %v", err)
+		}
+	}
+
+	// The simulated car connects through the HTTP endpoints like any other car, it keeps trying until the server listens
+	if config.Simulator.Enabled {
+		car, err := simulator.Start(config.Simulator, serverAddress, state.CarKey)
+		if err != nil {
+			return fmt.Errorf("Could not start simulated car: %v", err)
+		}
+		defer car.Stop()
+	}
 
 	// Strip http:// or https:// from the server address
 	addr := strings.ReplaceAll(serverAddress, "http://", "")
@@ -59,7 +83,7 @@ func onAbort(sig chan os.Signal, state *state.ServerState) {
 }
 
 // Configures log level and output
-func setupLogging(debug bool, outputPath string) {
+func setupLogging(config livestreamconfig.LogConfig) {
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnixMs
 
 	// Set up custom caller prefix
@@ -69,11 +93,14 @@ func setupLogging(debug bool, outputPath string) {
 		filepath := strings.Join(path[len(path)-3:], "/")
 		return fmt.Sprintf("[%s] %s:%d", "ForwardingServer", filepath, line)
 	}
-	outputWriter := zerolog.ConsoleWriter{Out: os.Stderr}
+	var outputWriter io.Writer = zerolog.ConsoleWriter{Out: os.Stderr}
+	if config.Format == "json" {
+		outputWriter = os.Stderr
+	}
 	log.Logger = log.Output(outputWriter).With().Caller().Logger()
-	if outputPath != "" {
+	if config.Output != "" {
 		file, err := os.OpenFile(
-			outputPath,
+			config.Output,
 			os.O_APPEND|os.O_CREATE|os.O_WRONLY,
 			0664,
 		)
@@ -81,15 +108,13 @@ func setupLogging(debug bool, outputPath string) {
 			panic(err)
 		}
 		log.Logger = zerolog.New(file).With().Timestamp().Logger()
-		fmt.Printf("Logging to file %s\n", outputPath)
+		fmt.Printf("Logging to file %s\n", config.Output)
 	}
 
-	// Set log level
-	zerolog.SetGlobalLevel(zerolog.InfoLevel)
-	if debug {
-		zerolog.SetGlobalLevel(zerolog.DebugLevel)
-		log.Debug().Msg("Debug logs enabled")
-	}
+	// Set log level (the level was validated when loading the configuration)
+	level, _ := zerolog.ParseLevel(config.Level)
+	zerolog.SetGlobalLevel(level)
+	log.Debug().Msg("Debug logs enabled")
 
 	log.Info().Msg("Logger was set up")
 }
@@ -97,14 +122,38 @@ func setupLogging(debug bool, outputPath string) {
 // Used to start the program with the correct arguments
 func main() {
 	// Parse args
+	configPath := flag.String("config", os.Getenv("ASE_FWSERVER_CONFIG"), "path of the YAML configuration file (environment variables override its values)")
 	debug := flag.Bool("debug", false, "show all logs (including debug)")
 	output := flag.String("output", "", "path of the output file to log to")
-	serverAddress := flag.String("server-address", livestreamconfig.ServerAddres, "address of the server to connect to")
+	serverAddress := flag.String("server-address", "", "address of the server to connect to (overrides the configured host and port)")
+	replayPath := flag.String("replay", "", "path of a recording to serve as a synthetic car in the default room")
+	replayLoop := flag.Bool("replay-loop", false, "start the replay over when it reaches the end of the recording")
+	simulateCar := flag.Bool("simulate-car", false, "connect a simulated car that streams a test pattern (see the simulator configuration)")
 	flag.Parse()
 
-	setupLogging(*debug, *output)
+	config, err := livestreamconfig.Load(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	// Command line flags take precedence over the configuration
+	if *debug {
+		config.Log.Level = "debug"
+	}
+	if *output != "" {
+		config.Log.Output = *output
+	}
+	if *simulateCar {
+		config.Simulator.Enabled = true
+	}
+	if *serverAddress == "" {
+		*serverAddress = fmt.Sprintf("%s://%s", livestreamconfig.ServerScheme, config.ServerAddress())
+	}
+
+	setupLogging(config.Log)
 
-	err := run(*serverAddress)
+	err = run(config, *serverAddress, *replayPath, *replayLoop)
 	if err != nil {
 		log.Err(err).Msg("An unhandled error occurred. Quitting.")
 		os.Exit(1)
@@ -0,0 +1,161 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+//
+// Cars can publish media tracks (e.g. H.264 or VP8 video) next to their data channels. The server acts as a selective forwarding unit:
+// the RTP packets of every track a car publishes are written to a single local track, which is added to the connection of every subscribed client.
+// The packets are not decoded, so the clients need to support the codec the car uses. Keyframe requests (PLI/FIR) of the clients are relayed to the car.
+//
+
+// Keyframes are expensive for the car to produce, so requests for the same track are combined if they follow each other this quickly
+const minKeyframeInterval = 500 * time.Millisecond
+
+// A track that is published by a car and forwarded to its subscribers
+type Track struct {
+	Local               *webrtc.TrackLocalStaticRTP // the track that is added to the connections of the clients
+	remote              *webrtc.TrackRemote
+	pc                  *webrtc.PeerConnection // the connection of the car, used to send keyframe requests
+	lastKeyframeRequest time.Time
+	lock                *sync.Mutex
+}
+
+// Forwards the media tracks of a single car to its subscribers
+type Forwarder struct {
+	CarId  string
+	tracks map[string]*Track // remote track id -> track
+	lock   *sync.RWMutex
+}
+
+func NewForwarder(carId string) *Forwarder {
+	return &Forwarder{
+		CarId:  carId,
+		tracks: make(map[string]*Track),
+		lock:   &sync.RWMutex{},
+	}
+}
+
+func (f *Forwarder) Log() zerolog.Logger {
+	return log.With().Str("context", "media").Str("carId", f.CarId).Logger()
+}
+
+// Starts forwarding a track that the car published over the given connection. The packets are forwarded until the track ends,
+// onEnded is called after the track was removed
+func (f *Forwarder) AddTrack(remote *webrtc.TrackRemote, pc *webrtc.PeerConnection, onEnded func(track *Track)) (*Track, error) {
+	// The stream id is the car id, so that clients can tell the tracks of different cars apart
+	local, err := webrtc.NewTrackLocalStaticRTP(remote.Codec().RTPCodecCapability, remote.ID(), f.CarId)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create local track: %v", err)
+	}
+
+	track := &Track{
+		Local:  local,
+		remote: remote,
+		pc:     pc,
+		lock:   &sync.Mutex{},
+	}
+
+	f.lock.Lock()
+	f.tracks[remote.ID()] = track
+	f.lock.Unlock()
+
+	log := f.Log()
+	log.Info().Str("trackId", remote.ID()).Str("codec", remote.Codec().MimeType).Msg("Forwarding media track of car")
+
+	go func() {
+		f.forward(track)
+
+		f.lock.Lock()
+		if f.tracks[remote.ID()] == track {
+			delete(f.tracks, remote.ID())
+		}
+		f.lock.Unlock()
+
+		log.Info().Str("trackId", remote.ID()).Msg("Media track of car ended")
+		if onEnded != nil {
+			onEnded(track)
+		}
+	}()
+
+	return track, nil
+}
+
+// Copies the RTP packets of the remote track to the local track until the remote track ends
+func (f *Forwarder) forward(track *Track) {
+	buffer := make([]byte, 1500)
+	for {
+		n, _, err := track.remote.Read(buffer)
+		if err != nil {
+			return
+		}
+
+		// Clients that went away are unbound from the track, so a closed pipe is not a reason to stop
+		if _, err := track.Local.Write(buffer[:n]); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			log := f.Log()
+			log.Err(err).Str("trackId", track.Local.ID()).Msg("Could not forward RTP packet")
+			return
+		}
+	}
+}
+
+// Returns all tracks that are currently forwarded, sorted by id so that clients receive them in a stable order
+func (f *Forwarder) Tracks() []*Track {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	tracks := make([]*Track, 0, len(f.tracks))
+	for _, track := range f.tracks {
+		tracks = append(tracks, track)
+	}
+	sort.Slice(tracks, func(i, j int) bool {
+		return tracks[i].Local.ID() < tracks[j].Local.ID()
+	})
+	return tracks
+}
+
+// Asks the car for a new keyframe, so that a (new) viewer can start decoding the track
+func (t *Track) RequestKeyframe() error {
+	t.lock.Lock()
+	if time.Since(t.lastKeyframeRequest) < minKeyframeInterval {
+		t.lock.Unlock()
+		return nil
+	}
+	t.lastKeyframeRequest = time.Now()
+	t.lock.Unlock()
+
+	return t.pc.WriteRTCP([]rtcp.Packet{
+		&rtcp.PictureLossIndication{MediaSSRC: uint32(t.remote.SSRC())},
+	})
+}
+
+// Reads the RTCP packets a client sends for a forwarded track until the sender is stopped, and relays its keyframe requests to the car.
+// Reading is also needed for the interceptors (e.g. NACK) to process the packets
+func (t *Track) RelayFeedback(sender *webrtc.RTPSender) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+
+		for _, packet := range packets {
+			switch packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				if err := t.RequestKeyframe(); err != nil {
+					log.Err(err).Str("trackId", t.Local.ID()).Msg("Could not relay keyframe request to car")
+				}
+			}
+		}
+	}
+}
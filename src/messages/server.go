@@ -0,0 +1,142 @@
+package messages
+
+import (
+	"encoding/json"
+
+	"vu/ase/streamserver/src/control"
+	"vu/ase/streamserver/src/fanout"
+	"vu/ase/streamserver/src/recording"
+	"vu/ase/streamserver/src/replay"
+
+	rtc "github.com/VU-ASE/roverrtc/src"
+)
+
+//
+// Server messages extend the rovercom ConfigMessage with actions that only concern passthrough (such as car subscriptions).
+// They are exchanged as JSON text messages on the meta channel, while ConfigMessages are always sent as binary protobuf messages.
+// This way, clients that do not know about server messages can keep using the meta channel as before.
+//
+
+// Actions that can be used in a server message
+const (
+	// client -> server
+	ActionSubscribe     = "subscribe"     // subscribe to the cars in CarIds
+	ActionListCars      = "listCars"      // request the list of connected cars
+	ActionListClients   = "listClients"   // request the list of connected clients
+	ActionHeartbeat     = "heartbeat"     // renew the control lease, only needed by controllers that do not send control data
+	ActionStreamOptions = "streamOptions" // change the maximum frame rate, pause state or quality of the frames the client receives (confirmed with the resulting options)
+
+	// client -> server, controllers and admins only
+	ActionControlReplay = "controlReplay" // pause, resume, seek or change the speed of the replay the client is routed to
+
+	// client -> server, admins only
+	ActionStartRecording = "startRecording" // start recording the room
+	ActionStopRecording  = "stopRecording"  // stop recording the room
+	ActionForceTakeover  = "forceTakeover"  // take over control, even if another client holds it (with an optional reason in Message)
+	ActionRevokeControl  = "revokeControl"  // take control away from the client in ControllerId, or remove it from the queue (with an optional reason in Message)
+	ActionListAudit      = "listAudit"      // request the audit log of privileged control actions
+
+	// server -> client
+	ActionSubscription   = "subscription"   // the cars the client is subscribed to now
+	ActionCars           = "cars"           // the list of connected cars
+	ActionClients        = "clients"        // the list of connected clients
+	ActionRecording      = "recording"      // the recording that was started or stopped
+	ActionReplayState    = "replayState"    // the playback state of a replay, sent to all clients of the replay when it changes
+	ActionCarStopped     = "carStopped"     // the server stopped the car in CarIds, because its controller went silent, disconnected or released control
+	ActionLease          = "lease"          // the control lease, sent to all clients when control is taken over and to the controller after every heartbeat
+	ActionQueue          = "queue"          // the clients waiting for control, sent to all clients whenever the queue changes
+	ActionControlRevoked = "controlRevoked" // an admin or a client with a higher priority took control away from the client (or removed it from the queue), sent to that client only
+	ActionAudit          = "audit"          // the audit log of privileged control actions
+	ActionFrameRate      = "frameRate"      // the frame rate the client receives, sent whenever it changes because the client cannot keep up (or caught up)
+	ActionTracksChanged  = "tracksChanged"  // the media tracks of the cars in CarIds changed, sent to clients that the server cannot renegotiate (they need to send a new offer)
+
+	// server -> car, only for cars that set serverMessages in their offer
+	ActionMaxFrameRate = "maxFrameRate" // none of the clients of the car keep up with it, it should not send more than MaxFrameRate frames per second (0 lifts the limit)
+	ActionError        = "error"        // the last server message could not be processed
+)
+
+// Describes a car as seen by the server
+type CarInfo struct {
+	Id              string `json:"id"`
+	Connected       bool   `json:"connected"`
+	TimestampOffset int64  `json:"timestampOffset"`
+	Replay          bool   `json:"replay,omitempty"`    // the car is a replay of a recording
+	LastError       string `json:"lastError,omitempty"` // the last error the car reported
+}
+
+// Describes a client as seen by the server
+type ClientDescription struct {
+	Id    string `json:"id"`    // the session id, as used in HumanControlState messages
+	Label string `json:"label"` // the id the client chose for itself
+	Role  string `json:"role"`
+	// How well frames are delivered to the client, including the number of frames that were dropped because it could not keep up
+	Frames *fanout.Stats `json:"frames,omitempty"`
+}
+
+// Changes what a client receives, fields that are not set are left as they are
+type StreamOptions struct {
+	MaxFrameRate *float64 `json:"maxFrameRate,omitempty"` // frames per second, 0 does not limit
+	Paused       *bool    `json:"paused,omitempty"`       // no frames are sent while paused (e.g. while the browser tab is hidden)
+	Quality      *string  `json:"quality,omitempty"`      // high, medium or low
+}
+
+// Changes the playback of a replay, fields that are not set are left as they are
+type ReplayControl struct {
+	Paused   *bool    `json:"paused,omitempty"`
+	Position *int64   `json:"position,omitempty"` // milliseconds since the first frame
+	Speed    *float64 `json:"speed,omitempty"`    // relative to the original timing
+}
+
+type ServerMessage struct {
+	Action       string               `json:"action"`
+	CarIds       []string             `json:"carIds,omitempty"`
+	Cars         []CarInfo            `json:"cars,omitempty"`
+	Clients      []ClientDescription  `json:"clients,omitempty"`
+	Recording    *recording.Info      `json:"recording,omitempty"`
+	Replay       *ReplayControl       `json:"replay,omitempty"`
+	ReplayState  *replay.State        `json:"replayState,omitempty"`
+	ControllerId string               `json:"controllerId,omitempty"` // the controller a message is about
+	Lease        *control.LeaseState  `json:"lease,omitempty"`
+	Queue        *control.QueueState  `json:"queue,omitempty"`
+	Audit        []control.AuditEntry `json:"audit,omitempty"`
+	FrameRate    *fanout.FrameRate    `json:"frameRate,omitempty"`
+	Stream       *StreamOptions       `json:"stream,omitempty"`
+	MaxFrameRate *float64             `json:"maxFrameRate,omitempty"`
+	Message      string               `json:"message,omitempty"` // human readable explanation, used for errors and as the reason of admin actions
+}
+
+// Parse a server message from a text message received on the meta channel
+func Parse(data []byte) (*ServerMessage, error) {
+	msg := ServerMessage{}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// Send a server message over the meta channel of a connection
+func Send(r *rtc.RTC, msg *ServerMessage) error {
+	log := r.Log()
+
+	// We don't need to report an error
+	if r.MetaChannel == nil {
+		log.Warn().Str("action", msg.Action).Msg("Cannot send server message. Meta channel is not configured")
+		return nil
+	}
+
+	content, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return r.MetaChannel.SendText(string(content))
+}
+
+// Describe a car connection as a CarInfo
+func DescribeCar(car *rtc.RTC) CarInfo {
+	return CarInfo{
+		Id:              car.Id,
+		Connected:       car.Pc != nil && car.IsConnected(),
+		TimestampOffset: car.TimestampOffset,
+	}
+}
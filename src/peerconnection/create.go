@@ -8,8 +8,10 @@ import (
 	"github.com/pion/webrtc/v4"
 )
 
-// Create new RTC connection from an SDP offer
-func CreateFromOffer(offer webrtc.SessionDescription, id string, peerConfig webrtc.Configuration, webrtcApi *webrtc.API) (*rtc.RTC, error) {
+// Create new RTC connection from an SDP offer. If a gatherer is given, trickle ICE is used: the answer is created immediately
+// and local candidates are delivered through the gatherer. Otherwise, this blocks until all local candidates are gathered.
+// The given tracks are sent to the peer, using the media sections it offered to receive on
+func CreateFromOffer(offer webrtc.SessionDescription, id string, peerConfig webrtc.Configuration, webrtcApi *webrtc.API, gatherer *Gatherer, tracks []webrtc.TrackLocal) (*rtc.RTC, error) {
 	// New RTC object that might be returned
 	rtc := rtc.NewRTC(id)
 
@@ -22,10 +24,24 @@ func CreateFromOffer(offer webrtc.SessionDescription, id string, peerConfig webr
 	}
 	rtc.Pc = peerConnection
 
-	// Fetch all pending ICE candidates (we will wait for the ICE gathering to complete before sending the answer)
+	// A peer connection that cannot be set up is closed again, so that its ICE agent and UDP mux registrations do not linger
+	created := false
+	defer func() {
+		if !created {
+			_ = peerConnection.Close()
+		}
+	}()
+
+	// Fetch all pending ICE candidates (without trickle ICE, we will wait for the ICE gathering to complete before sending the answer)
 	rtc.Pc.OnICECandidate(func(c *webrtc.ICECandidate) {
 		if c != nil {
 			rtc.AddLocalCandidate(c.ToJSON())
+			if gatherer != nil {
+				gatherer.add(c.ToJSON())
+			}
+		} else if gatherer != nil {
+			// A nil candidate signals that gathering is complete
+			gatherer.finish()
 		}
 	})
 
@@ -35,13 +51,20 @@ func CreateFromOffer(offer webrtc.SessionDescription, id string, peerConfig webr
 		return nil, fmt.Errorf("Could not set remote description: %v", err)
 	}
 
+	// Tracks need to be added before creating the answer, so that they take the media sections of the offer
+	for _, track := range tracks {
+		if _, err := rtc.Pc.AddTrack(track); err != nil {
+			return nil, fmt.Errorf("Could not add track: %v", err)
+		}
+	}
+
 	// Create answer for the remote peer (to confirm the connection)
 	answer, err := rtc.Pc.CreateAnswer(nil)
 	if err != nil {
 		return nil, fmt.Errorf("Could not create answer: %v", err)
 	}
 
-	// Create channel that is blocked until ICE Gathering is complete (don't use trickling ICE)
+	// Create channel that is blocked until ICE Gathering is complete (when not trickling ICE)
 	gatherComplete := webrtc.GatheringCompletePromise(rtc.Pc)
 
 	// Sets the LocalDescription, and starts our UDP listeners
@@ -50,10 +73,18 @@ func CreateFromOffer(offer webrtc.SessionDescription, id string, peerConfig webr
 		return nil, fmt.Errorf("Could not set local description: %v", err)
 	}
 
+	// With trickle ICE, the candidates are sent to the peer as soon as they are gathered
+	if gatherer != nil {
+		log.Info().Msg("Created answer, trickling ICE candidates")
+		created = true
+		return rtc, nil
+	}
+
 	// Block until ICE Gathering is complete, disabling trickle ICE so that we can send the answer as one blob
 	<-gatherComplete
 	// from this point on, the ICE candidates are complete (and we don't need locks anymore)
 	log.Info().Msg("ICE gathering completed")
 
+	created = true
 	return rtc, nil
 }
@@ -0,0 +1,96 @@
+package peerconnection
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Collects the local ICE candidates of a connection that uses trickle ICE, so that they can be delivered to the peer incrementally
+type Gatherer struct {
+	lock       *sync.Mutex
+	candidates []webrtc.ICECandidateInit
+	complete   bool
+	changed    chan struct{} // closed (and replaced) whenever a candidate is added or gathering completes
+	listener   func(candidate *webrtc.ICECandidateInit)
+}
+
+func NewGatherer() *Gatherer {
+	return &Gatherer{
+		lock:       &sync.Mutex{},
+		candidates: make([]webrtc.ICECandidateInit, 0),
+		changed:    make(chan struct{}),
+	}
+}
+
+func (g *Gatherer) add(candidate webrtc.ICECandidateInit) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.candidates = append(g.candidates, candidate)
+	close(g.changed)
+	g.changed = make(chan struct{})
+
+	if g.listener != nil {
+		g.listener(&candidate)
+	}
+}
+
+func (g *Gatherer) finish() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	// Gathering completes again after every ICE restart, the listener needs to know about each of them
+	if g.listener != nil {
+		g.listener(nil)
+	}
+
+	if g.complete {
+		return
+	}
+	g.complete = true
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
+
+// Calls the listener for every candidate that is gathered from now on, and with nil whenever gathering completes.
+// The listener is called in order and should not block for long
+func (g *Gatherer) OnCandidate(listener func(candidate *webrtc.ICECandidateInit)) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.listener = listener
+}
+
+// Returns the candidates that were gathered after the first `after` candidates, and the index to continue from.
+// If there are none yet, this blocks until a new candidate is gathered, gathering completes, the timeout passes or the context is done
+func (g *Gatherer) Wait(ctx context.Context, after int, timeout time.Duration) ([]webrtc.ICECandidateInit, int, bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		g.lock.Lock()
+		if after < 0 || after > len(g.candidates) {
+			after = len(g.candidates)
+		}
+		candidates := make([]webrtc.ICECandidateInit, len(g.candidates)-after)
+		copy(candidates, g.candidates[after:])
+		complete := g.complete
+		changed := g.changed
+		g.lock.Unlock()
+
+		if len(candidates) > 0 || complete {
+			return candidates, after + len(candidates), complete
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return candidates, after, complete
+		case <-ctx.Done():
+			return candidates, after, complete
+		}
+	}
+}
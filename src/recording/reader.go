@@ -0,0 +1,153 @@
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Where a record can be found in a recording file
+type entry struct {
+	offset     int64
+	length     int
+	receivedAt int64
+}
+
+// Reads the records of a recording. The file is indexed when it is opened, so that records can be read in any order without keeping them in memory
+type Reader struct {
+	Header  Header
+	CarId   string // the car whose frames are read
+	file    *os.File
+	entries []entry
+	lock    *sync.Mutex
+}
+
+// Opens a recording and indexes the frames of the given car. Without a car id, the first car that sent a frame is used
+func Open(path string, carId string) (*Reader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open recording: %v", err)
+	}
+
+	r := &Reader{
+		CarId:   carId,
+		file:    file,
+		entries: make([]entry, 0),
+		lock:    &sync.Mutex{},
+	}
+	if err := r.index(); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reads the header and finds the frames of the car
+func (r *Reader) index() error {
+	scanner := bufio.NewScanner(r.file)
+	// Frames can be a lot bigger than the default maximum line length
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+
+	offset := int64(0)
+	line := 0
+	for scanner.Scan() {
+		data := scanner.Bytes()
+		length := len(data)
+		line++
+
+		if line == 1 {
+			if err := json.Unmarshal(data, &r.Header); err != nil {
+				return fmt.Errorf("Could not parse recording header: %v", err)
+			}
+			if r.Header.Version != FormatVersion {
+				return fmt.Errorf("Recording has format version %d, only version %d is supported", r.Header.Version, FormatVersion)
+			}
+		} else {
+			// Only the fields that are needed for the index are parsed, the data is read when the record is played
+			record := struct {
+				Kind       string `json:"kind"`
+				ReceivedAt int64  `json:"receivedAt"`
+				CarId      string `json:"carId"`
+				ClientId   string `json:"clientId"`
+			}{}
+			if err := json.Unmarshal(data, &record); err != nil {
+				return fmt.Errorf("Could not parse record on line %d: %v", line, err)
+			}
+
+			if record.Kind == KindFrame && record.ClientId == "" {
+				if r.CarId == "" {
+					r.CarId = record.CarId
+				}
+				if record.CarId == r.CarId {
+					r.entries = append(r.entries, entry{
+						offset:     offset,
+						length:     length,
+						receivedAt: record.ReceivedAt,
+					})
+				}
+			}
+		}
+
+		// Every line ends with a newline, as written by the json.Encoder
+		offset += int64(length) + 1
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("Could not read recording: %v", err)
+	}
+
+	if line == 0 {
+		return fmt.Errorf("Recording is empty")
+	}
+	if len(r.entries) == 0 {
+		return fmt.Errorf("Recording does not contain any frames of car '%s'", r.CarId)
+	}
+	return nil
+}
+
+// The number of frames in the recording
+func (r *Reader) Len() int {
+	return len(r.entries)
+}
+
+// The time at which the frame was received, relative to the first frame (in milliseconds)
+func (r *Reader) Time(i int) int64 {
+	return r.entries[i].receivedAt - r.entries[0].receivedAt
+}
+
+// The time between the first and the last frame (in milliseconds)
+func (r *Reader) Duration() int64 {
+	return r.Time(len(r.entries) - 1)
+}
+
+// Returns the index of the first frame at or after the given time (relative to the first frame, in milliseconds)
+func (r *Reader) Search(time int64) int {
+	return sort.Search(len(r.entries), func(i int) bool {
+		return r.Time(i) >= time
+	})
+}
+
+// Reads the frame with the given index
+func (r *Reader) Read(i int) (*Record, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	e := r.entries[i]
+	data := make([]byte, e.length)
+	if _, err := r.file.ReadAt(data, e.offset); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("Could not read record: %v", err)
+	}
+
+	record := Record{}
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("Could not parse record: %v", err)
+	}
+	return &record, nil
+}
+
+func (r *Reader) Close() error {
+	return r.file.Close()
+}
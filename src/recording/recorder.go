@@ -0,0 +1,190 @@
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+//
+// A recording captures everything that passes through a room: car frames, client control messages and meta messages of both sides.
+// Every recording is a file with one JSON object per line. The first line is a Header, every following line is a Record.
+// Binary payloads are base64 encoded (as encoding/json does for byte slices), so recordings can be read without any custom tooling.
+//
+
+// The version of the recording format, increased whenever the format changes in an incompatible way
+const FormatVersion = 1
+
+// Kinds of records
+const (
+	KindFrame   = "frame"   // car -> clients, from the frame channel
+	KindControl = "control" // client -> car (or car -> active controller, without client id), from the control channel
+	KindMeta    = "meta"    // car or client -> server, from the meta channel
+)
+
+// The extension of recording files
+const extension = ".jsonl"
+
+var validName = regexp.MustCompile(`^[a-zA-Z0-9_-]+\` + extension + `$`)
+
+// The first line of a recording
+type Header struct {
+	Version   int    `json:"version"`
+	RoomId    string `json:"roomId"`
+	StartedAt int64  `json:"startedAt"` // unix milliseconds, server time
+}
+
+// A single message that passed through the room
+type Record struct {
+	Kind       string `json:"kind"`
+	Timestamp  int64  `json:"timestamp"`          // server receive time plus the timestamp offset of the car, in unix milliseconds
+	ReceivedAt int64  `json:"receivedAt"`         // server receive time, in unix milliseconds
+	CarId      string `json:"carId,omitempty"`    // the car that sent or would receive the message
+	ClientId   string `json:"clientId,omitempty"` // the client that sent the message, empty for messages of the car
+	Text       bool   `json:"text,omitempty"`     // the message was sent as a text message
+	Data       []byte `json:"data"`
+}
+
+// Describes a recording file
+type Info struct {
+	Name       string `json:"name"`
+	Size       int64  `json:"size"`
+	ModifiedAt int64  `json:"modifiedAt"` // unix milliseconds
+	Active     bool   `json:"active"`     // the recording is still being written
+}
+
+// Writes the records of a single recording to its file
+type Recorder struct {
+	Name    string
+	path    string
+	file    *os.File
+	writer  *bufio.Writer
+	encoder *json.Encoder
+	lock    *sync.Mutex
+}
+
+// Creates a new recording for a room in the given directory, the file name is based on the current time
+func Start(directory string, roomId string, now time.Time) (*Recorder, error) {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, fmt.Errorf("Could not create recording directory: %v", err)
+	}
+
+	name := fmt.Sprintf("%s-%03d%s", now.UTC().Format("20060102-150405"), now.Nanosecond()/int(time.Millisecond), extension)
+	path := filepath.Join(directory, name)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create recording file: %v", err)
+	}
+
+	writer := bufio.NewWriter(file)
+	r := &Recorder{
+		Name:    name,
+		path:    path,
+		file:    file,
+		writer:  writer,
+		encoder: json.NewEncoder(writer),
+		lock:    &sync.Mutex{},
+	}
+
+	err = r.encoder.Encode(Header{
+		Version:   FormatVersion,
+		RoomId:    roomId,
+		StartedAt: now.UnixMilli(),
+	})
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("Could not write recording header: %v", err)
+	}
+	return r, nil
+}
+
+// Appends a record to the recording
+func (r *Recorder) Write(record Record) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.file == nil {
+		return fmt.Errorf("Recording %s was already stopped", r.Name)
+	}
+	return r.encoder.Encode(record)
+}
+
+// Flushes all records to disk and closes the file
+func (r *Recorder) Stop() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+
+	err := r.writer.Flush()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	r.file = nil
+	return err
+}
+
+// Describes the recording, it stays active until it is stopped
+func (r *Recorder) Info() Info {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	info := Info{
+		Name:   r.Name,
+		Active: r.file != nil,
+	}
+	if fileInfo, err := os.Stat(r.path); err == nil {
+		info.Size = fileInfo.Size()
+		info.ModifiedAt = fileInfo.ModTime().UnixMilli()
+	}
+	return info
+}
+
+// Returns the recordings in a directory, newest first. The recording with the active name is marked as active
+func List(directory string, active string) ([]Info, error) {
+	entries, err := os.ReadDir(directory)
+	if os.IsNotExist(err) {
+		return []Info{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Could not read recording directory: %v", err)
+	}
+
+	infos := make([]Info, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !validName.MatchString(entry.Name()) {
+			continue
+		}
+		fileInfo, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		infos = append(infos, Info{
+			Name:       entry.Name(),
+			Size:       fileInfo.Size(),
+			ModifiedAt: fileInfo.ModTime().UnixMilli(),
+			Active:     entry.Name() == active,
+		})
+	}
+
+	// The names start with the time the recording was started
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name > infos[j].Name
+	})
+	return infos, nil
+}
+
+// Returns the path of a recording in a directory, or an error if the name is not a valid recording name
+func Path(directory string, name string) (string, error) {
+	if !validName.MatchString(name) {
+		return "", fmt.Errorf("Invalid recording name '%s'", name)
+	}
+	return filepath.Join(directory, name), nil
+}
@@ -0,0 +1,257 @@
+package replay
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"vu/ase/streamserver/src/recording"
+
+	"github.com/rs/zerolog/log"
+)
+
+//
+// A player replays the frames of a recording with their original timing, as if they were sent by a live car.
+// Playback can be paused, sped up or slowed down, and moved to any point in the recording.
+//
+
+// The playback speeds that can be used, relative to the original timing
+const (
+	MinSpeed = 0.1
+	MaxSpeed = 10.0
+)
+
+// Describes the playback of a recording
+type State struct {
+	Name     string  `json:"name"`  // the name of the recording
+	CarId    string  `json:"carId"` // the id of the synthetic car
+	Paused   bool    `json:"paused"`
+	Speed    float64 `json:"speed"`
+	Position int64   `json:"position"` // milliseconds since the first frame
+	Duration int64   `json:"duration"` // milliseconds between the first and the last frame
+	Loop     bool    `json:"loop"`     // playback starts over at the end of the recording
+}
+
+type Player struct {
+	Name   string
+	CarId  string
+	reader *recording.Reader
+	send   func(record *recording.Record)
+	loop   bool
+	lock   *sync.Mutex
+	paused bool
+	speed  float64
+	next   int // the index of the next frame to send
+	// The position in the recording at the anchor time, from which the current position is derived
+	anchorPosition int64
+	anchorTime     time.Time
+	changed        chan struct{} // closed (and replaced) whenever playback is paused, resumed, moved or sped up
+	started        bool
+	stopped        chan struct{}
+	stopOnce       *sync.Once
+}
+
+// Creates a player that replays a recording as the car with the given id, send is called for every frame at the time it is due.
+// Nothing is sent until playback is started with Play. The player owns the reader from now on
+func New(name string, carId string, reader *recording.Reader, loop bool, send func(record *recording.Record)) *Player {
+	return &Player{
+		Name:       name,
+		CarId:      carId,
+		reader:     reader,
+		send:       send,
+		loop:       loop,
+		lock:       &sync.Mutex{},
+		speed:      1,
+		anchorTime: time.Now(),
+		changed:    make(chan struct{}),
+		stopped:    make(chan struct{}),
+		stopOnce:   &sync.Once{},
+	}
+}
+
+// Starts playback from the current position, a player that was stopped does not play anymore
+func (p *Player) Play() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.started {
+		return
+	}
+	select {
+	case <-p.stopped:
+		return
+	default:
+	}
+
+	p.started = true
+	p.anchorTime = time.Now()
+	go p.run()
+}
+
+// Sends the frames when they are due, until the player is stopped
+func (p *Player) run() {
+	defer p.reader.Close()
+
+	for {
+		p.lock.Lock()
+		if p.next >= p.reader.Len() {
+			if p.loop {
+				p.moveTo(0)
+			} else if !p.paused {
+				// Stay at the end of the recording until playback is moved back
+				p.anchorPosition = p.reader.Duration()
+				p.paused = true
+			}
+		}
+
+		changed := p.changed
+		paused := p.paused || p.next >= p.reader.Len()
+		var wait time.Duration
+		if !paused {
+			wait = time.Duration(float64(p.reader.Time(p.next)-p.position())/p.speed) * time.Millisecond
+		}
+		p.lock.Unlock()
+
+		if paused {
+			wait = time.Hour
+		}
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-changed:
+				timer.Stop()
+				continue
+			case <-p.stopped:
+				timer.Stop()
+				return
+			}
+			if paused {
+				continue
+			}
+		}
+
+		// Playback might have changed while waiting
+		p.lock.Lock()
+		if changed != p.changed {
+			p.lock.Unlock()
+			continue
+		}
+		i := p.next
+		p.next++
+		p.lock.Unlock()
+
+		record, err := p.reader.Read(i)
+		if err != nil {
+			log.Err(err).Str("recording", p.Name).Msg("Could not read frame to replay")
+			continue
+		}
+
+		select {
+		case <-p.stopped:
+			return
+		default:
+			p.send(record)
+		}
+	}
+}
+
+// The current position in the recording, the caller needs to hold the lock
+func (p *Player) position() int64 {
+	if p.paused {
+		return p.anchorPosition
+	}
+	return p.anchorPosition + int64(float64(time.Since(p.anchorTime).Milliseconds())*p.speed)
+}
+
+// Moves playback to the given position, the caller needs to hold the lock
+func (p *Player) moveTo(position int64) {
+	p.next = p.reader.Search(position)
+	p.anchorPosition = position
+	p.anchorTime = time.Now()
+}
+
+// Wakes up the playback loop, the caller needs to hold the lock
+func (p *Player) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+func (p *Player) Pause() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.paused {
+		return
+	}
+	p.anchorPosition = p.position()
+	p.paused = true
+	p.notify()
+}
+
+func (p *Player) Resume() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if !p.paused {
+		return
+	}
+	p.anchorTime = time.Now()
+	p.paused = false
+	p.notify()
+}
+
+// Moves playback to the given position (milliseconds since the first frame)
+func (p *Player) SetPosition(position int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	position = max(0, min(position, p.reader.Duration()))
+	p.moveTo(position)
+	p.notify()
+}
+
+// Changes the playback speed, relative to the original timing
+func (p *Player) SetSpeed(speed float64) error {
+	if speed < MinSpeed || speed > MaxSpeed {
+		return fmt.Errorf("Playback speed needs to be between %.1f and %.1f", MinSpeed, MaxSpeed)
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.anchorPosition = p.position()
+	p.anchorTime = time.Now()
+	p.speed = speed
+	p.notify()
+	return nil
+}
+
+func (p *Player) State() State {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return State{
+		Name:     p.Name,
+		CarId:    p.CarId,
+		Paused:   p.paused,
+		Speed:    p.speed,
+		Position: min(p.position(), p.reader.Duration()),
+		Duration: p.reader.Duration(),
+		Loop:     p.loop,
+	}
+}
+
+// Stops playback and closes the recording
+func (p *Player) Stop() {
+	p.stopOnce.Do(func() {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+
+		close(p.stopped)
+		// Otherwise, the playback loop closes the recording when it notices that the player stopped
+		if !p.started {
+			_ = p.reader.Close()
+		}
+	})
+}
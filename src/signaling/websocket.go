@@ -0,0 +1,116 @@
+package signaling
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"vu/ase/streamserver/src/auth"
+
+	pb_remote_config_messages "github.com/VU-ASE/rovercom/packages/go"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v4"
+	"google.golang.org/protobuf/proto"
+)
+
+//
+// WebSocket signaling lets cars and clients negotiate their connection over a single long-lived connection (/ws) instead of
+// several HTTP requests. Signaling messages are JSON text messages in both directions, which makes trickle ICE, renegotiation
+// and ICE restarts (initiated by either side) possible. The server also pushes its notifications (the same ConfigMessages
+// that are sent over the meta channel) as binary messages, so that peers receive them before their data channels are open.
+//
+
+// Types of signaling messages
+const (
+	// peer -> server and server -> peer
+	TypeOffer     = "offer"     // an initial offer, or a renegotiation (which can restart ICE)
+	TypeAnswer    = "answer"    // the answer to the last offer
+	TypeCandidate = "candidate" // a trickled ICE candidate, without a candidate when gathering is complete
+
+	// peer -> server
+	TypeRestart = "restart" // ask the server to renegotiate and restart ICE
+
+	// server -> peer
+	TypeError  = "error"  // the last message could not be processed
+	TypeClosed = "closed" // the peer connection was closed, a new offer creates a new connection
+)
+
+const (
+	// How long a peer can stay silent before the WebSocket is closed, the server pings more often than this
+	PongTimeout  = 30 * time.Second
+	PingInterval = 10 * time.Second
+	writeTimeout = 5 * time.Second
+)
+
+type Message struct {
+	Type           string                     `json:"type"`
+	SDP            *webrtc.SessionDescription `json:"sdp,omitempty"`
+	Candidate      *webrtc.ICECandidateInit   `json:"candidate,omitempty"`
+	SessionId      string                     `json:"sessionId,omitempty"`      // set in the answer to the initial offer
+	Label          string                     `json:"label,omitempty"`          // client offers only, the id the client chose for itself
+	CarIds         []string                   `json:"carIds,omitempty"`         // client offers only, the cars to subscribe to
+	Timestamp      int64                      `json:"timestamp,omitempty"`      // car offers only, the timestamp of the car
+	ServerMessages bool                       `json:"serverMessages,omitempty"` // car offers only, the car understands JSON server messages on its meta channel
+	Message        string                     `json:"message,omitempty"`        // human readable explanation, used for errors
+}
+
+// The signaling session of a single WebSocket connection
+type Session struct {
+	CarId       string      // the authenticated id of the car, empty for clients
+	Role        auth.Role   // the role of the client, unused for cars
+	PeerId      string      // the id of the peer connection that is negotiated over this session, empty before the first offer
+	Negotiation *sync.Mutex // held while negotiating, so that candidates are never sent before the description they belong to
+	conn        *websocket.Conn
+	writeLock   *sync.Mutex
+}
+
+func NewSession(conn *websocket.Conn, carId string, role auth.Role) *Session {
+	return &Session{
+		CarId:       carId,
+		Role:        role,
+		Negotiation: &sync.Mutex{},
+		conn:        conn,
+		writeLock:   &sync.Mutex{},
+	}
+}
+
+// Returns true if the peer on the other side is a car
+func (s *Session) IsCar() bool {
+	return s.CarId != ""
+}
+
+// Send a signaling message to the peer
+func (s *Session) Send(msg Message) error {
+	content, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return s.write(websocket.TextMessage, content)
+}
+
+// Send a server notification to the peer
+func (s *Session) Notify(notification *pb_remote_config_messages.ConfigMessage) error {
+	content, err := proto.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	return s.write(websocket.BinaryMessage, content)
+}
+
+// Send a ping to keep the connection alive
+func (s *Session) Ping() error {
+	return s.write(websocket.PingMessage, nil)
+}
+
+func (s *Session) write(messageType int, data []byte) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	_ = s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return s.conn.WriteMessage(messageType, data)
+}
+
+func (s *Session) Close() error {
+	return s.conn.Close()
+}
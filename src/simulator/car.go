@@ -0,0 +1,352 @@
+package simulator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"vu/ase/streamserver/src/auth"
+	livestreamconfig "vu/ase/streamserver/src/config"
+	"vu/ase/streamserver/src/events"
+	"vu/ase/streamserver/src/messages"
+
+	pb_remote_config_messages "github.com/VU-ASE/rovercom/packages/go"
+	pb_module_outputs "github.com/VU-ASE/rovercom/packages/go/outputs"
+	rtc "github.com/VU-ASE/roverrtc/src"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/protobuf/proto"
+)
+
+//
+// The simulated car connects to the server like a physical car would: it signs its SDP offer, sends it to the car endpoint
+// and opens the meta, control and frame data channels. Its frames are test patterns, wrapped in the same sensor output
+// that the camera of a car sends. This makes the behavior of clients reproducible without any hardware.
+//
+
+const (
+	// How long to wait before connecting again after the connection was lost (or could not be set up)
+	reconnectInterval = 2 * time.Second
+	// Frames are dropped instead of queued when the frame channel cannot keep up
+	maxBufferedFrameBytes = 1 << 20
+)
+
+type Car struct {
+	Id       string
+	config   livestreamconfig.SimulatorConfig
+	endpoint string // the car SDP endpoint of the server
+	key      []byte // the key to sign requests with, requests are not signed if empty
+	client   *http.Client
+	stopped  chan struct{}
+	stopOnce *sync.Once
+	// The frame rate the server asked the car to stay under (as float64 bits), 0 if the server did not ask
+	maxFrameRate *atomic.Uint64
+}
+
+// Starts a simulated car that connects to the server listening on the given address, and reconnects whenever the connection is lost
+func Start(config livestreamconfig.SimulatorConfig, serverAddress string, key []byte) (*Car, error) {
+	endpoint, err := carEndpoint(serverAddress, config.Room)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Car{
+		Id:           config.CarId,
+		config:       config,
+		endpoint:     endpoint,
+		key:          key,
+		client:       &http.Client{Timeout: 30 * time.Second},
+		stopped:      make(chan struct{}),
+		stopOnce:     &sync.Once{},
+		maxFrameRate: &atomic.Uint64{},
+	}
+	go c.run()
+	return c, nil
+}
+
+// Returns the URL of the car SDP endpoint, the server is reached over the loopback interface if it listens on all interfaces
+func carEndpoint(serverAddress string, room string) (string, error) {
+	u, err := url.Parse(serverAddress)
+	if err != nil {
+		return "", fmt.Errorf("Invalid server address '%s': %v", serverAddress, err)
+	}
+
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		return "", fmt.Errorf("Invalid server address '%s': %v", serverAddress, err)
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	u.Host = net.JoinHostPort(host, port)
+
+	u.Path = "/car/sdp"
+	if room != "" {
+		u.Path = "/rooms/" + url.PathEscape(room) + "/car/sdp"
+	}
+	return u.String(), nil
+}
+
+func (c *Car) Log() zerolog.Logger {
+	return log.With().Str("context", "simulator").Str("carId", c.Id).Logger()
+}
+
+// Keeps the car connected until it is stopped
+func (c *Car) run() {
+	log := c.Log()
+	log.Info().Str("endpoint", c.endpoint).Int("frameRate", c.config.FrameRate).Int("width", c.config.Width).Int("height", c.config.Height).Msg("Started simulated car")
+
+	for {
+		if err := c.connect(); err != nil {
+			log.Warn().Err(err).Msgf("Simulated car is not connected, trying again in %s", reconnectInterval)
+		}
+
+		select {
+		case <-c.stopped:
+			return
+		case <-time.After(reconnectInterval):
+		}
+	}
+}
+
+// Sets up a connection with the server and streams frames until the connection is lost or the car is stopped
+func (c *Car) connect() error {
+	log := c.Log()
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return fmt.Errorf("Could not create peer connection: %v", err)
+	}
+	defer pc.Close()
+
+	lost := make(chan struct{})
+	lostOnce := &sync.Once{}
+	pc.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		log.Debug().Msgf("Simulated car connection changed to new state %s", s.String())
+
+		if s == webrtc.PeerConnectionStateDisconnected || s == webrtc.PeerConnectionStateClosed || s == webrtc.PeerConnectionStateFailed {
+			lostOnce.Do(func() {
+				close(lost)
+			})
+		}
+	})
+
+	meta, err := pc.CreateDataChannel(livestreamconfig.MetaChannelLabel, nil)
+	if err != nil {
+		return fmt.Errorf("Could not create meta channel: %v", err)
+	}
+	meta.OnMessage(c.onMetaMessage)
+
+	control, err := pc.CreateDataChannel(livestreamconfig.ControlChannelLabel, nil)
+	if err != nil {
+		return fmt.Errorf("Could not create control channel: %v", err)
+	}
+	control.OnMessage(func(msg webrtc.DataChannelMessage) {
+		c.onControlMessage(control, msg)
+	})
+
+	// Late frames are useless, so they are not retransmitted
+	ordered := false
+	maxRetransmits := uint16(0)
+	frame, err := pc.CreateDataChannel(livestreamconfig.FrameChannelLabel, &webrtc.DataChannelInit{
+		Ordered:        &ordered,
+		MaxRetransmits: &maxRetransmits,
+	})
+	if err != nil {
+		return fmt.Errorf("Could not create frame channel: %v", err)
+	}
+	frame.OnOpen(func() {
+		log.Info().Msg("Simulated car is streaming test pattern frames")
+		go c.streamFrames(frame, lost)
+	})
+
+	// The server does not trickle candidates to cars that use HTTP signaling, so all candidates are sent with the offer
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return fmt.Errorf("Could not create offer: %v", err)
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		return fmt.Errorf("Could not set local description: %v", err)
+	}
+	<-gatherComplete
+
+	answer, err := c.signal(*pc.LocalDescription())
+	if err != nil {
+		return err
+	}
+	if err := pc.SetRemoteDescription(*answer); err != nil {
+		return fmt.Errorf("Could not set remote description: %v", err)
+	}
+
+	select {
+	case <-lost:
+		return fmt.Errorf("Connection was lost")
+	case <-c.stopped:
+		return nil
+	}
+}
+
+// Sends the offer to the server, signed with the car key, and returns the answer
+func (c *Car) signal(offer webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	// The simulated car follows maxFrameRate server messages, so it opts in to them
+	body, err := json.Marshal(events.CarRequestSDP{
+		RequestSDP: rtc.RequestSDP{
+			Offer:     offer,
+			Id:        c.Id,
+			Timestamp: time.Now().UnixMilli(),
+		},
+		ServerMessages: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if len(c.key) > 0 {
+		request.Header.Set("Authorization", auth.CarAuthScheme+" "+auth.SignCarRequest(c.key, body))
+	}
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("Could not send offer: %v", err)
+	}
+	defer response.Body.Close()
+
+	payload, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read answer: %v", err)
+	}
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return nil, fmt.Errorf("Server rejected offer (%s): %s", response.Status, bytes.TrimSpace(payload))
+	}
+
+	// The answer also contains the session id, which is the car id for cars
+	answer := webrtc.SessionDescription{}
+	if err := json.Unmarshal(payload, &answer); err != nil {
+		return nil, fmt.Errorf("Could not parse answer: %v", err)
+	}
+	return &answer, nil
+}
+
+// Sends a test pattern frame at the configured rate until the connection is lost or the car is stopped
+func (c *Car) streamFrames(dc *webrtc.DataChannel, lost chan struct{}) {
+	log := c.Log()
+	pattern := newPattern(c.config.Width, c.config.Height)
+
+	ticker := time.NewTicker(time.Second / time.Duration(c.config.FrameRate))
+	defer ticker.Stop()
+
+	// A new connection starts without a limit, the server asks again if it needs to
+	c.maxFrameRate.Store(0)
+
+	n := uint64(0)
+	lastSent := time.Time{}
+	for {
+		select {
+		case <-lost:
+			return
+		case <-c.stopped:
+			return
+		case <-ticker.C:
+		}
+
+		n++
+		if dc.BufferedAmount() > maxBufferedFrameBytes {
+			log.Debug().Uint64("frame", n).Msg("Frame channel is congested, dropping frame")
+			continue
+		}
+		// The ticker keeps running at the configured rate, frames are left out to stay under the rate the server asked for
+		if limit := math.Float64frombits(c.maxFrameRate.Load()); limit > 0 && time.Since(lastSent) < time.Duration(0.9*float64(time.Second)/limit) {
+			continue
+		}
+		lastSent = time.Now()
+
+		jpeg, err := pattern.frame(n)
+		if err != nil {
+			log.Err(err).Msg("Could not draw test pattern")
+			continue
+		}
+
+		data, err := proto.Marshal(&pb_module_outputs.SensorOutput{
+			Timestamp: uint64(time.Now().UnixMilli()),
+			SensorOutput: &pb_module_outputs.SensorOutput_CameraOutput{
+				CameraOutput: &pb_module_outputs.CameraSensorOutput{
+					DebugFrame: &pb_module_outputs.CameraSensorOutput_DebugFrame{
+						Jpeg: jpeg,
+					},
+				},
+			},
+		})
+		if err != nil {
+			log.Err(err).Msg("Could not encode frame")
+			continue
+		}
+
+		if err := dc.Send(data); err != nil {
+			log.Err(err).Msg("Could not send frame")
+		}
+	}
+}
+
+// Logs the messages the server sends, these are protobuf notifications or JSON server messages
+func (c *Car) onMetaMessage(msg webrtc.DataChannelMessage) {
+	log := c.Log()
+
+	if msg.IsString {
+		log.Info().Str("message", string(msg.Data)).Msg("Simulated car received meta message")
+
+		if parsed, err := messages.Parse(msg.Data); err == nil && parsed.Action == messages.ActionMaxFrameRate && parsed.MaxFrameRate != nil {
+			c.maxFrameRate.Store(math.Float64bits(*parsed.MaxFrameRate))
+		}
+		return
+	}
+
+	notification := pb_remote_config_messages.ConfigMessage{}
+	if err := proto.Unmarshal(msg.Data, &notification); err != nil {
+		log.Warn().Err(err).Int("length", len(msg.Data)).Msg("Simulated car received meta message that is not a config message")
+		return
+	}
+	log.Info().Str("message", notification.String()).Msg("Simulated car received meta message")
+}
+
+// Logs the control messages that clients send through the server, and sends them back if configured
+func (c *Car) onControlMessage(dc *webrtc.DataChannel, msg webrtc.DataChannelMessage) {
+	log := c.Log()
+	log.Info().Int("length", len(msg.Data)).Bool("text", msg.IsString).Msg("Simulated car received control message")
+
+	if !c.config.EchoControl {
+		return
+	}
+
+	var err error
+	if msg.IsString {
+		err = dc.SendText(string(msg.Data))
+	} else {
+		err = dc.Send(msg.Data)
+	}
+	if err != nil {
+		log.Err(err).Msg("Could not echo control message")
+	}
+}
+
+// Disconnects the car, it does not reconnect afterwards
+func (c *Car) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stopped)
+	})
+}
@@ -0,0 +1,69 @@
+package simulator
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+)
+
+// The colors of the bars in the test pattern, from left to right
+var barColors = []color.RGBA{
+	{R: 192, G: 192, B: 192, A: 255}, // gray
+	{R: 192, G: 192, B: 0, A: 255},   // yellow
+	{R: 0, G: 192, B: 192, A: 255},   // cyan
+	{R: 0, G: 192, B: 0, A: 255},     // green
+	{R: 192, G: 0, B: 192, A: 255},   // magenta
+	{R: 192, G: 0, B: 0, A: 255},     // red
+	{R: 0, G: 0, B: 192, A: 255},     // blue
+}
+
+// The number of bits of the frame counter that are drawn at the bottom of the test pattern
+const counterBits = 16
+
+// Draws test pattern frames: color bars with a bar that sweeps across the image, and the frame number as a row of black and white blocks.
+// This makes it easy to see that frames arrive, in the right order and without stalls
+type pattern struct {
+	width  int
+	height int
+	image  *image.RGBA
+}
+
+func newPattern(width int, height int) *pattern {
+	return &pattern{
+		width:  width,
+		height: height,
+		image:  image.NewRGBA(image.Rect(0, 0, width, height)),
+	}
+}
+
+// Draws the given frame and encodes it as a JPEG
+func (p *pattern) frame(n uint64) ([]byte, error) {
+	counterTop := p.height * 7 / 8
+	sweep := int(n*4) % p.width
+	sweepWidth := max(1, p.width/64)
+
+	for y := 0; y < p.height; y++ {
+		for x := 0; x < p.width; x++ {
+			var c color.RGBA
+			switch {
+			case x >= sweep && x < sweep+sweepWidth:
+				c = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+			case y < counterTop:
+				c = barColors[x*len(barColors)/p.width]
+			case n&(1<<(counterBits-1-x*counterBits/p.width)) != 0:
+				c = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+			default:
+				c = color.RGBA{A: 255}
+			}
+			p.image.SetRGBA(x, y, c)
+		}
+	}
+
+	buffer := bytes.Buffer{}
+	if err := jpeg.Encode(&buffer, p.image, &jpeg.Options{Quality: 75}); err != nil {
+		return nil, fmt.Errorf("Could not encode test pattern: %v", err)
+	}
+	return buffer.Bytes(), nil
+}
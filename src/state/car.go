@@ -1,13 +1,16 @@
 package state
 
 import (
+	"encoding/base64"
 	"fmt"
-	"os"
+	"strings"
 	"sync"
+	"time"
 	livestreamconfig "vu/ase/streamserver/src/config"
+	"vu/ase/streamserver/src/control"
 
-	rtc "github.com/VU-ASE/roverrtc/src"
 	"github.com/pion/ice/v3"
+	"github.com/pion/interceptor"
 	"github.com/pion/webrtc/v4"
 
 	"github.com/rs/zerolog/log"
@@ -16,49 +19,106 @@ import (
 // This makes the server easier to test and mock and also allows us to
 // add more fields to the server state in the future.
 type ServerState struct {
-	RtcApi           *webrtc.API
-	ConnectedPeers   *rtc.RTCMap
-	ActiveController string        // id of the controller that is currently controlling the car
-	Lock             *sync.RWMutex // to make sure ICE candidates can be managed concurrently
+	RtcApi      *webrtc.API
+	Config      *livestreamconfig.Config
+	CarKey      []byte           // the key cars use to sign their signaling requests, car requests are not verified if empty
+	ClientKey   []byte           // the key client tokens are signed with, clients are not verified if empty
+	StopMessage []byte           // the control message that stops a car, sent when its controller goes silent or disconnects
+	Policy      control.Policy   // decides who gets control when a client requests it while another client holds it
+	rooms       map[string]*Room // room id -> room
+	roomsLock   *sync.RWMutex
 }
 
-func NewServerState() (*ServerState, error) {
+func NewServerState(config *livestreamconfig.Config) (*ServerState, error) {
 	s := webrtc.SettingEngine{}
 
 	// This is necessary when running through Docker, so that the ICE candidates can be resolved
-	serverIp := os.Getenv("ASE_FWSERVER_IP")
-	if serverIp == "" {
-		return nil, fmt.Errorf("ASE_FWSERVER_IP environment variable not set. Please set it to your local IP address (192.168.0.XXX)")
-	} else {
-		log.Info().Msgf("ForwardingServer webRTC listener active on '%s:%d'", serverIp, livestreamconfig.MuxUdpPort)
+	s.SetNAT1To1IPs(config.WebRTC.NatIps, webrtc.ICECandidateTypeHost)
+	s.SetICETimeouts(config.WebRTC.DisconnectedTimeout, config.WebRTC.FailedTimeout, config.WebRTC.KeepAliveInterval)
+
+	// Multiplex all ICE traffic over the configured UDP ports
+	muxes := make([]ice.UDPMux, 0, len(config.WebRTC.MuxUdpPorts))
+	for _, port := range config.WebRTC.MuxUdpPorts {
+		mux, err := ice.NewMultiUDPMuxFromPort(port)
+		if err != nil {
+			return nil, fmt.Errorf("Could not create UDP mux on port %d: %v", port, err)
+		}
+		muxes = append(muxes, mux)
+		log.Info().Msgf("ForwardingServer webRTC listener active on '%s:%d'", strings.Join(config.WebRTC.NatIps, ","), port)
+	}
+	s.SetICEUDPMux(ice.NewMultiUDPMuxDefault(muxes...))
+
+	// Cars need to sign their signaling requests with this key, so that no one else can register as a car
+	if config.Auth.CarKey == "" {
+		log.Warn().Msg("No car key configured (auth.carKey or ASE_FWSERVER_CAR_KEY). Anyone on the network can register as a car")
+	}
+
+	// Clients need a token signed with this key, which also determines their role
+	if config.Auth.ClientKey == "" {
+		log.Warn().Msg("No client key configured (auth.clientKey or ASE_FWSERVER_CLIENT_KEY). Every client is allowed to take over control")
 	}
-	s.SetNAT1To1IPs([]string{serverIp}, webrtc.ICECandidateTypeHost)
 
-	mux, err := ice.NewMultiUDPMuxFromPort(livestreamconfig.MuxUdpPort)
+	// Cars are stopped with this message when their controller goes silent
+	stopMessage, err := base64.StdEncoding.DecodeString(config.Control.StopMessage)
 	if err != nil {
-		return nil, fmt.Errorf("Could not create UDP mux: %v", err)
+		return nil, fmt.Errorf("Could not decode stop message: %v", err)
+	}
+	if len(stopMessage) == 0 {
+		if stopMessage, err = control.DefaultStopMessage(); err != nil {
+			return nil, fmt.Errorf("Could not encode default stop message: %v", err)
+		}
+	}
+
+	policy, err := control.NewPolicy(config.Control.Policy)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cars can publish media tracks that are forwarded to the clients as they are, so the codecs of the car need to be known
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		return nil, fmt.Errorf("Could not register codecs: %v", err)
+	}
+
+	// The default interceptors take care of NACKs, RTCP reports and congestion control feedback for the forwarded tracks
+	i := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		return nil, fmt.Errorf("Could not register interceptors: %v", err)
 	}
-	s.SetICEUDPMux(mux)
 
 	// Create a local PeerConnection
-	api := webrtc.NewAPI(webrtc.WithSettingEngine(s))
-
-	return &ServerState{
-		RtcApi:           api,
-		ConnectedPeers:   rtc.NewRTCMap(),
-		ActiveController: "",
-		Lock:             &sync.RWMutex{},
-	}, nil
+	api := webrtc.NewAPI(webrtc.WithSettingEngine(s), webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i))
+
+	state := &ServerState{
+		RtcApi:      api,
+		Config:      config,
+		CarKey:      []byte(config.Auth.CarKey),
+		ClientKey:   []byte(config.Auth.ClientKey),
+		StopMessage: stopMessage,
+		Policy:      policy,
+		rooms:       make(map[string]*Room),
+		roomsLock:   &sync.RWMutex{},
+	}
+
+	// The default room always exists, it is used by the endpoints that are not scoped to a room
+	state.rooms[livestreamconfig.DefaultRoomId] = newRoom(livestreamconfig.DefaultRoomId, state)
+
+	return state, nil
+}
+
+// Returns the configuration for a new peer connection, ICE server credentials are generated for every connection
+func (s *ServerState) PeerConnectionConfig() webrtc.Configuration {
+	return s.Config.PeerConnectionConfig(time.Now())
 }
 
 // Destroy all connections and the server state
 func (s *ServerState) Destroy() {
-	s.Lock.Lock()
-	defer s.Lock.Unlock()
+	s.roomsLock.Lock()
+	defer s.roomsLock.Unlock()
 
-	for _, peer := range s.ConnectedPeers.UnsafeGetAll() {
-		_ = s.ConnectedPeers.Remove(peer.Id)
-		peer.Destroy()
+	for id, room := range s.rooms {
+		room.Destroy()
+		delete(s.rooms, id)
 	}
 
 	log.Info().Msg("Destroyed server state")
@@ -0,0 +1,72 @@
+package state
+
+import (
+	"time"
+
+	rtc "github.com/VU-ASE/roverrtc/src"
+)
+
+//
+// Cars report their status (e.g. errors) with meta messages. The server keeps the latest status of every connected car,
+// so that clients that subscribe later can still see it in the car list.
+//
+
+// Server-side information about a connected car, learned from its offer and the meta messages it sent
+type CarStatus struct {
+	// The car understands JSON server messages on its meta channel, it said so in its offer
+	ServerMessages bool
+	LastError      string // the last error the car reported, empty if it did not report any
+	LastErrorAt    int64  // unix milliseconds
+	LastMessageAt  int64  // unix milliseconds, when the car last sent a meta message
+	// The offset between the clock of the car and the server clock as the car measured it, 0 if it did not measure it
+	TimestampOffset int64
+	// The frame rate the car was asked to stay under because none of its clients could keep up, 0 if it was not asked
+	MaxFrameRate   float64
+	MaxFrameRateAt int64       // unix milliseconds
+	LiftTimer      *time.Timer // checks whether the frame rate limit can be lifted once it was kept long enough, nil if never needed
+}
+
+// Changes the status of a car and returns a copy of the new status
+func (room *Room) UpdateCarStatus(carId string, update func(status *CarStatus)) CarStatus {
+	room.carStatusLock.Lock()
+	defer room.carStatusLock.Unlock()
+
+	status := room.carStatus[carId]
+	if status == nil {
+		status = &CarStatus{}
+		room.carStatus[carId] = status
+	}
+	update(status)
+	return *status
+}
+
+// Returns a copy of the status of a car, the status is empty if the car did not report anything
+func (room *Room) GetCarStatus(carId string) CarStatus {
+	room.carStatusLock.RLock()
+	defer room.carStatusLock.RUnlock()
+
+	if status := room.carStatus[carId]; status != nil {
+		return *status
+	}
+	return CarStatus{}
+}
+
+// Returns the offset between the clock of a car and the server clock. The offset the car measured itself is more precise
+// than the one the server measured when the car registered (which is set before the car is added to the room, and never changes)
+func (room *Room) CarTimestampOffset(car *rtc.RTC) int64 {
+	if offset := room.GetCarStatus(car.Id).TimestampOffset; offset != 0 {
+		return offset
+	}
+	return car.TimestampOffset
+}
+
+// Forget the status of a car (e.g. when the car disconnects)
+func (room *Room) RemoveCarStatus(carId string) {
+	room.carStatusLock.Lock()
+	defer room.carStatusLock.Unlock()
+
+	if status := room.carStatus[carId]; status != nil && status.LiftTimer != nil {
+		status.LiftTimer.Stop()
+	}
+	delete(room.carStatus, carId)
+}
@@ -0,0 +1,109 @@
+package state
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"vu/ase/streamserver/src/auth"
+)
+
+// Server-side information about a connected client, stored next to its RTC connection
+type ClientInfo struct {
+	Id     string    // the session id, assigned by the server
+	Role   auth.Role // what the client is allowed to do
+	Label  string    // the id the client chose for itself, only used for display purposes
+	Secret string    // only known to the client that created the session, other clients do know its session id
+}
+
+// Prefix of all client session ids, so that they can never be confused with car ids
+const sessionIdPrefix = "client-"
+
+// Generates a new opaque session id for a client
+func NewSessionId() (string, error) {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", fmt.Errorf("Could not generate session id: %v", err)
+	}
+	return sessionIdPrefix + hex.EncodeToString(bytes), nil
+}
+
+// Generates a new secret for a client session, which the client needs to prove that a session is its own
+func NewSessionSecret() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", fmt.Errorf("Could not generate session secret: %v", err)
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// Returns true if the id is a client session id, cars cannot use these ids
+func IsSessionId(id string) bool {
+	return strings.HasPrefix(id, sessionIdPrefix)
+}
+
+// Store the information of a newly connected client
+func (room *Room) SetClientInfo(clientId string, info ClientInfo) {
+	room.clientsLock.Lock()
+	defer room.clientsLock.Unlock()
+
+	info.Id = clientId
+	room.clients[clientId] = &info
+}
+
+// Returns a copy of the information of a client, or nil if the client is unknown
+func (room *Room) GetClientInfo(clientId string) *ClientInfo {
+	room.clientsLock.RLock()
+	defer room.clientsLock.RUnlock()
+
+	info := room.clients[clientId]
+	if info == nil {
+		return nil
+	}
+	infoCopy := *info
+	return &infoCopy
+}
+
+// Returns the role of a client, unknown clients are treated as viewers
+func (room *Room) ClientRole(clientId string) auth.Role {
+	info := room.GetClientInfo(clientId)
+	if info == nil {
+		return auth.RoleViewer
+	}
+	return info.Role
+}
+
+// Returns true if the secret belongs to the session of the client
+func (room *Room) VerifySessionSecret(clientId string, secret string) bool {
+	info := room.GetClientInfo(clientId)
+	if info == nil || info.Secret == "" || secret == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(info.Secret), []byte(secret)) == 1
+}
+
+// Forget the information of a client (e.g. when the client disconnects)
+func (room *Room) RemoveClientInfo(clientId string) {
+	room.clientsLock.Lock()
+	defer room.clientsLock.Unlock()
+
+	delete(room.clients, clientId)
+}
+
+// Returns a copy of the information of all clients, sorted by session id
+func (room *Room) GetAllClientInfo() []ClientInfo {
+	room.clientsLock.RLock()
+	defer room.clientsLock.RUnlock()
+
+	infos := make([]ClientInfo, 0, len(room.clients))
+	for _, info := range room.clients {
+		infos = append(infos, *info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Id < infos[j].Id
+	})
+	return infos
+}
@@ -0,0 +1,39 @@
+package state
+
+import (
+	"vu/ase/streamserver/src/fanout"
+)
+
+//
+// Every client has a sender that delivers frames and relayed car messages on its own goroutine (see the fanout package).
+//
+
+func (room *Room) SetSender(clientId string, sender *fanout.Sender) {
+	room.sendersLock.Lock()
+	defer room.sendersLock.Unlock()
+
+	room.senders[clientId] = sender
+}
+
+// Returns the sender of a client, or nil if the client is not connected
+func (room *Room) GetSender(clientId string) *fanout.Sender {
+	room.sendersLock.RLock()
+	defer room.sendersLock.RUnlock()
+
+	return room.senders[clientId]
+}
+
+// Stops and forgets the sender of a client (e.g. when the client disconnects), returns the stopped sender or nil if there was none.
+// The connection of the client is not used anymore once this returns
+func (room *Room) RemoveSender(clientId string) *fanout.Sender {
+	room.sendersLock.Lock()
+	sender := room.senders[clientId]
+	delete(room.senders, clientId)
+	room.sendersLock.Unlock()
+
+	// The sender might need the lock itself before it can stop (e.g. to look up other senders)
+	if sender != nil {
+		sender.Stop()
+	}
+	return sender
+}
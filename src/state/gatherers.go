@@ -0,0 +1,33 @@
+package state
+
+import (
+	"vu/ase/streamserver/src/peerconnection"
+)
+
+//
+// Peers that use trickle ICE fetch the local candidates of their connection from the gatherer of that connection.
+// Car ids and client session ids never collide, so both can be stored in the same map.
+//
+
+func (room *Room) SetGatherer(peerId string, gatherer *peerconnection.Gatherer) {
+	room.gatherersLock.Lock()
+	defer room.gatherersLock.Unlock()
+
+	room.gatherers[peerId] = gatherer
+}
+
+// Returns the gatherer of a peer, or nil if the peer does not use trickle ICE
+func (room *Room) GetGatherer(peerId string) *peerconnection.Gatherer {
+	room.gatherersLock.RLock()
+	defer room.gatherersLock.RUnlock()
+
+	return room.gatherers[peerId]
+}
+
+// Forget the gatherer of a peer (e.g. when the peer disconnects)
+func (room *Room) RemoveGatherer(peerId string) {
+	room.gatherersLock.Lock()
+	defer room.gatherersLock.Unlock()
+
+	delete(room.gatherers, peerId)
+}
@@ -0,0 +1,43 @@
+package state
+
+import (
+	"vu/ase/streamserver/src/media"
+)
+
+//
+// Every car has a forwarder for the media tracks it publishes, clients receive the tracks of the cars they are subscribed to.
+//
+
+func (room *Room) SetForwarder(carId string, forwarder *media.Forwarder) {
+	room.forwardersLock.Lock()
+	defer room.forwardersLock.Unlock()
+
+	room.forwarders[carId] = forwarder
+}
+
+// Returns the forwarder of a car, or nil if the car is not connected
+func (room *Room) GetForwarder(carId string) *media.Forwarder {
+	room.forwardersLock.RLock()
+	defer room.forwardersLock.RUnlock()
+
+	return room.forwarders[carId]
+}
+
+// Forget the forwarder of a car (e.g. when the car disconnects)
+func (room *Room) RemoveForwarder(carId string) {
+	room.forwardersLock.Lock()
+	defer room.forwardersLock.Unlock()
+
+	delete(room.forwarders, carId)
+}
+
+// Returns the media tracks of all cars a client is subscribed to
+func (room *Room) TracksForClient(clientId string) []*media.Track {
+	tracks := make([]*media.Track, 0)
+	for _, car := range room.SubscribedCars(clientId) {
+		if forwarder := room.GetForwarder(car.Id); forwarder != nil {
+			tracks = append(tracks, forwarder.Tracks()...)
+		}
+	}
+	return tracks
+}
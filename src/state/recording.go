@@ -0,0 +1,90 @@
+package state
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"vu/ase/streamserver/src/recording"
+)
+
+//
+// A room can be recorded to disk (see the recording package). Every room has its own subdirectory in the recording directory.
+//
+
+// The directory that holds the recordings of the room
+func (room *Room) RecordingDirectory() string {
+	return filepath.Join(room.Server.Config.Recording.Directory, room.Id)
+}
+
+// Starts recording the room, returns an error if the room is already being recorded
+func (room *Room) StartRecording() (*recording.Recorder, error) {
+	room.recorderLock.Lock()
+	defer room.recorderLock.Unlock()
+
+	if room.recorder != nil {
+		return nil, fmt.Errorf("Room is already being recorded to %s", room.recorder.Name)
+	}
+
+	recorder, err := recording.Start(room.RecordingDirectory(), room.Id, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	room.recorder = recorder
+
+	log := room.Log()
+	log.Info().Str("recording", recorder.Name).Msg("Started recording")
+	return recorder, nil
+}
+
+// Stops the recording of the room, returns an error if the room is not being recorded
+func (room *Room) StopRecording() (*recording.Recorder, error) {
+	room.recorderLock.Lock()
+	defer room.recorderLock.Unlock()
+
+	recorder := room.recorder
+	if recorder == nil {
+		return nil, fmt.Errorf("Room is not being recorded")
+	}
+	room.recorder = nil
+
+	if err := recorder.Stop(); err != nil {
+		return nil, fmt.Errorf("Could not finish recording %s: %v", recorder.Name, err)
+	}
+
+	log := room.Log()
+	log.Info().Str("recording", recorder.Name).Msg("Stopped recording")
+	return recorder, nil
+}
+
+// Returns the name of the active recording, or an empty string if the room is not being recorded
+func (room *Room) ActiveRecording() string {
+	room.recorderLock.RLock()
+	defer room.recorderLock.RUnlock()
+
+	if room.recorder == nil {
+		return ""
+	}
+	return room.recorder.Name
+}
+
+// Returns true if messages passing through the room should be recorded
+func (room *Room) IsRecording() bool {
+	return room.ActiveRecording() != ""
+}
+
+// Adds a record to the active recording, if any
+func (room *Room) Record(record recording.Record) {
+	room.recorderLock.RLock()
+	recorder := room.recorder
+	room.recorderLock.RUnlock()
+
+	if recorder == nil {
+		return
+	}
+
+	if err := recorder.Write(record); err != nil {
+		log := room.Log()
+		log.Err(err).Str("recording", recorder.Name).Msg("Could not write record")
+	}
+}
@@ -0,0 +1,45 @@
+package state
+
+import (
+	"vu/ase/streamserver/src/replay"
+)
+
+//
+// Replays act as synthetic cars: they are added to the connected cars of the room (without a peer connection),
+// so that clients can subscribe to them and receive their frames like they would from a live car.
+//
+
+func (room *Room) SetPlayer(carId string, player *replay.Player) {
+	room.playersLock.Lock()
+	defer room.playersLock.Unlock()
+
+	room.players[carId] = player
+}
+
+// Returns the player of a synthetic car, or nil if the car is not a replay
+func (room *Room) GetPlayer(carId string) *replay.Player {
+	room.playersLock.RLock()
+	defer room.playersLock.RUnlock()
+
+	return room.players[carId]
+}
+
+// Forget the player of a synthetic car (e.g. when the replay is stopped)
+func (room *Room) RemovePlayer(carId string) {
+	room.playersLock.Lock()
+	defer room.playersLock.Unlock()
+
+	delete(room.players, carId)
+}
+
+// Returns all players of the room
+func (room *Room) GetAllPlayers() []*replay.Player {
+	room.playersLock.RLock()
+	defer room.playersLock.RUnlock()
+
+	players := make([]*replay.Player, 0, len(room.players))
+	for _, player := range room.players {
+		players = append(players, player)
+	}
+	return players
+}
@@ -0,0 +1,47 @@
+package state
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+//
+// WHIP and WHEP sessions are addressed by a resource id (in the Location URL) that only the peer that created the session knows.
+// The peer id cannot be used for this, because car ids and session ids are shared with other clients (e.g. in HumanControlState messages).
+//
+
+// Creates a new resource id for the session of a peer
+func (room *Room) NewResource(peerId string) (string, error) {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", fmt.Errorf("Could not generate resource id: %v", err)
+	}
+	resourceId := hex.EncodeToString(bytes)
+
+	room.resourcesLock.Lock()
+	defer room.resourcesLock.Unlock()
+
+	room.resources[resourceId] = peerId
+	return resourceId, nil
+}
+
+// Returns the id of the peer a resource belongs to, or an empty string if the resource does not exist
+func (room *Room) ResourcePeer(resourceId string) string {
+	room.resourcesLock.RLock()
+	defer room.resourcesLock.RUnlock()
+
+	return room.resources[resourceId]
+}
+
+// Forget all resources of a peer (e.g. when the peer disconnects)
+func (room *Room) RemoveResources(peerId string) {
+	room.resourcesLock.Lock()
+	defer room.resourcesLock.Unlock()
+
+	for resourceId, id := range room.resources {
+		if id == peerId {
+			delete(room.resources, resourceId)
+		}
+	}
+}
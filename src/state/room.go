@@ -0,0 +1,209 @@
+package state
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	livestreamconfig "vu/ase/streamserver/src/config"
+	"vu/ase/streamserver/src/control"
+	"vu/ase/streamserver/src/fanout"
+	"vu/ase/streamserver/src/media"
+	"vu/ase/streamserver/src/peerconnection"
+	"vu/ase/streamserver/src/recording"
+	"vu/ase/streamserver/src/replay"
+	"vu/ase/streamserver/src/signaling"
+
+	rtc "github.com/VU-ASE/roverrtc/src"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+//
+// Rooms isolate groups of cars and clients from each other (e.g. one room per student team).
+// Clients only see the cars in their own room, and every room arbitrates human control on its own.
+//
+
+type Room struct {
+	Id               string
+	Server           *ServerState        // the server this room belongs to
+	ConnectedCars    *rtc.RTCMap         // car id -> car connection
+	ConnectedClients *rtc.RTCMap         // client id -> client connection
+	ActiveController string              // id of the controller that is currently controlling the car
+	Lock             *sync.RWMutex       // to make sure the active controller can be managed concurrently
+	Watchdog         *control.Watchdog   // stops the car when the active controller goes silent
+	Lease            *control.Lease      // releases control when the active controller stops renewing it
+	Queue            *control.Queue      // the clients that wait for control, and the turn of the active controller
+	Audit            *control.AuditLog   // the privileged control actions of admins
+	subscriptions    map[string][]string // client id -> ids of the cars the client subscribed to
+	subscribeLock    *sync.Mutex
+	clients          map[string]*ClientInfo // client id -> server-side client information
+	clientsLock      *sync.RWMutex
+	carStatus        map[string]*CarStatus // car id -> status reported by the car
+	carStatusLock    *sync.RWMutex
+	senders          map[string]*fanout.Sender // client id -> sender of the frames and relayed car messages for the client
+	sendersLock      *sync.RWMutex
+	gatherers        map[string]*peerconnection.Gatherer // peer id -> local candidates, for peers that use trickle ICE
+	gatherersLock    *sync.RWMutex
+	resources        map[string]string // WHIP/WHEP resource id -> peer id
+	resourcesLock    *sync.RWMutex
+	signaling        map[string]*signaling.Session // peer id -> WebSocket signaling session, for peers that negotiate over a WebSocket
+	signalingLock    *sync.RWMutex
+	forwarders       map[string]*media.Forwarder // car id -> forwarder of the media tracks the car publishes
+	forwardersLock   *sync.RWMutex
+	recorder         *recording.Recorder // the active recording of the room, nil if the room is not being recorded
+	recorderLock     *sync.RWMutex
+	players          map[string]*replay.Player // car id -> player, for the synthetic cars that replay a recording
+	playersLock      *sync.RWMutex
+	acquired         int // number of requests that are still adding a peer to the room, guarded by the rooms lock of the server
+}
+
+var validRoomId = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+func newRoom(id string, server *ServerState) *Room {
+	return &Room{
+		Id:               id,
+		Server:           server,
+		ConnectedCars:    rtc.NewRTCMap(),
+		ConnectedClients: rtc.NewRTCMap(),
+		ActiveController: "",
+		Lock:             &sync.RWMutex{},
+		Watchdog:         control.NewWatchdog(server.Config.Control.WatchdogTimeout),
+		Lease:            control.NewLease(server.Config.Control.LeaseTTL),
+		Queue:            control.NewQueue(server.Config.Control.MaxTurn),
+		Audit:            control.NewAuditLog(),
+		subscriptions:    make(map[string][]string),
+		subscribeLock:    &sync.Mutex{},
+		clients:          make(map[string]*ClientInfo),
+		clientsLock:      &sync.RWMutex{},
+		carStatus:        make(map[string]*CarStatus),
+		carStatusLock:    &sync.RWMutex{},
+		senders:          make(map[string]*fanout.Sender),
+		sendersLock:      &sync.RWMutex{},
+		gatherers:        make(map[string]*peerconnection.Gatherer),
+		gatherersLock:    &sync.RWMutex{},
+		resources:        make(map[string]string),
+		resourcesLock:    &sync.RWMutex{},
+		signaling:        make(map[string]*signaling.Session),
+		signalingLock:    &sync.RWMutex{},
+		forwarders:       make(map[string]*media.Forwarder),
+		forwardersLock:   &sync.RWMutex{},
+		recorderLock:     &sync.RWMutex{},
+		players:          make(map[string]*replay.Player),
+		playersLock:      &sync.RWMutex{},
+	}
+}
+
+// Create an easy function to get a logger with the room id already set
+func (room *Room) Log() zerolog.Logger {
+	return log.With().Str("roomId", room.Id).Logger()
+}
+
+// Returns the room with the given id, creating it if it does not exist yet. The room is not removed until the caller
+// releases it with ReleaseRoom, so that it does not disappear before the caller added its peer to it
+func (s *ServerState) AcquireRoom(id string) (*Room, error) {
+	if !validRoomId.MatchString(id) {
+		return nil, fmt.Errorf("Invalid room id '%s', only letters, digits, '-' and '_' are allowed", id)
+	}
+
+	s.roomsLock.Lock()
+	defer s.roomsLock.Unlock()
+
+	room := s.rooms[id]
+	if room == nil {
+		if len(s.rooms) >= s.Config.Rooms.Max {
+			return nil, fmt.Errorf("Maximum number of rooms reached")
+		}
+
+		room = newRoom(id, s)
+		s.rooms[id] = room
+		log.Info().Str("roomId", id).Msg("Created room")
+	}
+
+	room.acquired++
+	return room, nil
+}
+
+// Releases a room that was returned by AcquireRoom, the room is removed if nothing was added to it
+func (s *ServerState) ReleaseRoom(room *Room) {
+	s.roomsLock.Lock()
+	defer s.roomsLock.Unlock()
+
+	room.acquired--
+	s.removeRoomIfEmpty(room)
+}
+
+// Removes the room if it has no cars, clients, replays, signaling sessions or active recording left, so that rooms
+// do not count towards the maximum number of rooms forever. The default room is never removed
+func (room *Room) RemoveIfEmpty() {
+	room.Server.roomsLock.Lock()
+	defer room.Server.roomsLock.Unlock()
+
+	room.Server.removeRoomIfEmpty(room)
+}
+
+// The rooms lock needs to be held by the caller
+func (s *ServerState) removeRoomIfEmpty(room *Room) {
+	if room.Id == livestreamconfig.DefaultRoomId || s.rooms[room.Id] != room || !room.isEmpty() {
+		return
+	}
+
+	delete(s.rooms, room.Id)
+	log := room.Log()
+	log.Info().Msg("Removed empty room")
+}
+
+func (room *Room) isEmpty() bool {
+	if room.acquired > 0 || room.IsRecording() || len(room.GetAllPlayers()) > 0 {
+		return false
+	}
+	if len(room.ConnectedCars.GetAllIds()) > 0 || len(room.ConnectedClients.GetAllIds()) > 0 {
+		return false
+	}
+
+	room.signalingLock.RLock()
+	defer room.signalingLock.RUnlock()
+	return len(room.signaling) == 0
+}
+
+// Returns the room with the given id, or nil if it does not exist
+func (s *ServerState) GetRoom(id string) *Room {
+	s.roomsLock.RLock()
+	defer s.roomsLock.RUnlock()
+
+	return s.rooms[id]
+}
+
+// Returns the room that is used by the endpoints that are not scoped to a room
+func (s *ServerState) DefaultRoom() *Room {
+	return s.GetRoom(livestreamconfig.DefaultRoomId)
+}
+
+// Destroy all connections in the room
+func (room *Room) Destroy() {
+	// Synthetic cars do not have a connection to destroy
+	for _, player := range room.GetAllPlayers() {
+		player.Stop()
+		room.RemovePlayer(player.CarId)
+		_ = room.ConnectedCars.Remove(player.CarId)
+	}
+
+	for _, peers := range []*rtc.RTCMap{room.ConnectedClients, room.ConnectedCars} {
+		for _, peer := range peers.UnsafeGetAll() {
+			_ = peers.Remove(peer.Id)
+			room.RemoveSender(peer.Id)
+			peer.Destroy()
+		}
+	}
+
+	// Make sure that the recording is complete on disk
+	if room.IsRecording() {
+		if _, err := room.StopRecording(); err != nil {
+			log := room.Log()
+			log.Err(err).Msg("Could not stop recording")
+		}
+	}
+
+	log := room.Log()
+	log.Info().Msg("Destroyed room")
+}
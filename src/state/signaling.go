@@ -0,0 +1,35 @@
+package state
+
+import (
+	"vu/ase/streamserver/src/signaling"
+)
+
+//
+// Peers that negotiate over a WebSocket can receive server-initiated offers and notifications through their signaling session.
+// Car ids and client session ids never collide, so both can be stored in the same map.
+//
+
+func (room *Room) SetSignaling(peerId string, session *signaling.Session) {
+	room.signalingLock.Lock()
+	defer room.signalingLock.Unlock()
+
+	room.signaling[peerId] = session
+}
+
+// Returns the signaling session of a peer, or nil if the peer does not use WebSocket signaling
+func (room *Room) GetSignaling(peerId string) *signaling.Session {
+	room.signalingLock.RLock()
+	defer room.signalingLock.RUnlock()
+
+	return room.signaling[peerId]
+}
+
+// Forget the signaling session of a peer, but only if it is still the given session (a peer can reconnect over a new WebSocket)
+func (room *Room) RemoveSignaling(peerId string, session *signaling.Session) {
+	room.signalingLock.Lock()
+	defer room.signalingLock.Unlock()
+
+	if room.signaling[peerId] == session {
+		delete(room.signaling, peerId)
+	}
+}
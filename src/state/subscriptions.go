@@ -0,0 +1,120 @@
+package state
+
+import (
+	"sort"
+
+	rtc "github.com/VU-ASE/roverrtc/src"
+)
+
+//
+// Multiple cars can be connected to a room at the same time. Every client subscribes to one or more of them, which determines
+// which cars it receives frames and car state from. Control data is routed to the first connected car in the subscription.
+// Clients that did not subscribe to any car explicitly follow the default car.
+//
+
+// Returns the car that clients without a subscription follow (the connected car with the lowest id), or nil if no car is connected
+func (room *Room) DefaultCar() *rtc.RTC {
+	ids := room.ConnectedCars.GetAllIds()
+	if len(ids) == 0 {
+		return nil
+	}
+	sort.Strings(ids)
+
+	return room.ConnectedCars.Get(ids[0])
+}
+
+// Subscribe a client to the given cars, replacing its previous subscription. The cars do not need to be connected yet.
+// An empty list resets the subscription, so that the client follows the default car again
+func (room *Room) Subscribe(clientId string, carIds []string) {
+	room.subscribeLock.Lock()
+	defer room.subscribeLock.Unlock()
+
+	if len(carIds) == 0 {
+		delete(room.subscriptions, clientId)
+		return
+	}
+
+	// Remove duplicates, but keep the order (the first car receives the control data)
+	subscription := make([]string, 0, len(carIds))
+	seen := make(map[string]bool)
+	for _, id := range carIds {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			subscription = append(subscription, id)
+		}
+	}
+	room.subscriptions[clientId] = subscription
+}
+
+// Returns a copy of the ids of the cars a client explicitly subscribed to (empty if it follows the default car)
+func (room *Room) Subscription(clientId string) []string {
+	room.subscribeLock.Lock()
+	defer room.subscribeLock.Unlock()
+
+	subscription := make([]string, len(room.subscriptions[clientId]))
+	copy(subscription, room.subscriptions[clientId])
+	return subscription
+}
+
+// Forget the subscription of a client (e.g. when the client disconnects)
+func (room *Room) Unsubscribe(clientId string) {
+	room.subscribeLock.Lock()
+	defer room.subscribeLock.Unlock()
+
+	delete(room.subscriptions, clientId)
+}
+
+// Returns all connected cars a client is subscribed to
+func (room *Room) SubscribedCars(clientId string) []*rtc.RTC {
+	subscription := room.Subscription(clientId)
+	if len(subscription) == 0 {
+		if car := room.DefaultCar(); car != nil {
+			return []*rtc.RTC{car}
+		}
+		return []*rtc.RTC{}
+	}
+
+	cars := make([]*rtc.RTC, 0, len(subscription))
+	for _, id := range subscription {
+		if car := room.ConnectedCars.Get(id); car != nil {
+			cars = append(cars, car)
+		}
+	}
+	return cars
+}
+
+// Returns the car that the control data of a client is routed to, or nil if none of its cars are connected
+func (room *Room) CarForClient(clientId string) *rtc.RTC {
+	cars := room.SubscribedCars(clientId)
+	if len(cars) == 0 {
+		return nil
+	}
+	return cars[0]
+}
+
+// Returns true if the client receives frames and car state from the given car
+func (room *Room) IsSubscribed(clientId string, carId string) bool {
+	for _, car := range room.SubscribedCars(clientId) {
+		if car.Id == carId {
+			return true
+		}
+	}
+	return false
+}
+
+// Executes a function for each client that is subscribed to the given car
+func (room *Room) ForEachClientOfCar(carId string, f func(id string, client *rtc.RTC)) {
+	room.ConnectedClients.ForEach(func(id string, client *rtc.RTC) {
+		if room.IsSubscribed(id, carId) {
+			f(id, client)
+		}
+	})
+}
+
+// Removes a car from the list of connected cars, unless it was already replaced by a newer connection with the same id
+func (room *Room) RemoveCar(car *rtc.RTC) {
+	if room.ConnectedCars.Get(car.Id) != car {
+		return
+	}
+	_ = room.ConnectedCars.Remove(car.Id)
+}
@@ -0,0 +1,143 @@
+package turnserver
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	livestreamconfig "vu/ase/streamserver/src/config"
+
+	"github.com/pion/turn/v3"
+	"github.com/rs/zerolog/log"
+)
+
+//
+// The embedded TURN server relays traffic for peers that cannot reach the server directly (e.g. a rover behind a firewall).
+// It only accepts the time-limited credentials (TURN REST API) that the server hands out to its own peer connections
+// and to authenticated clients on /client/ice-servers, so it shares its authentication with the signaling endpoints.
+// Peers can only relay to public addresses and to this server, not into its private network.
+//
+
+type Server struct {
+	turn   *turn.Server
+	config livestreamconfig.TurnConfig
+}
+
+// Starts the TURN server. The public IP defaults to the first NAT IP of the WebRTC configuration
+func Start(config livestreamconfig.TurnConfig, natIps []string) (*Server, error) {
+	if config.PublicIp == "" && len(natIps) > 0 {
+		config.PublicIp = natIps[0]
+	}
+	publicIp := net.ParseIP(config.PublicIp)
+	if publicIp == nil {
+		return nil, fmt.Errorf("TURN server needs a public IP address")
+	}
+
+	// Credentials are only valid for this run if no secret was configured
+	if config.Secret == "" {
+		bytes := make([]byte, 32)
+		if _, err := rand.Read(bytes); err != nil {
+			return nil, fmt.Errorf("Could not generate TURN secret: %v", err)
+		}
+		config.Secret = hex.EncodeToString(bytes)
+	}
+
+	udpListener, err := net.ListenPacket("udp4", fmt.Sprintf("0.0.0.0:%d", config.Port))
+	if err != nil {
+		return nil, fmt.Errorf("Could not create TURN listener: %v", err)
+	}
+
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:       config.Realm,
+		AuthHandler: authHandler(config.Secret),
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &turn.RelayAddressGeneratorPortRange{
+					RelayAddress: publicIp,
+					Address:      "0.0.0.0",
+					MinPort:      uint16(config.RelayMinPort),
+					MaxPort:      uint16(config.RelayMaxPort),
+				},
+				PermissionHandler: permissionHandler(config.AllowPrivatePeers, append([]string{config.PublicIp}, natIps...)),
+			},
+		},
+	})
+	if err != nil {
+		_ = udpListener.Close()
+		return nil, fmt.Errorf("Could not start TURN server: %v", err)
+	}
+
+	log.Info().Msgf("ForwardingServer TURN listener active on '%s:%d' (relay ports %d-%d)", config.PublicIp, config.Port, config.RelayMinPort, config.RelayMaxPort)
+
+	return &Server{
+		turn:   server,
+		config: config,
+	}, nil
+}
+
+// The ICE server entry that advertises this TURN server to peers
+func (s *Server) ICEServer() livestreamconfig.ICEServer {
+	return livestreamconfig.ICEServer{
+		URLs:   []string{fmt.Sprintf("turn:%s:%d?transport=udp", s.config.PublicIp, s.config.Port)},
+		Secret: s.config.Secret,
+	}
+}
+
+func (s *Server) Close() error {
+	return s.turn.Close()
+}
+
+// Accepts usernames of the form "<expiry>" or "<expiry>:<username>" as long as they did not expire,
+// the password is the HMAC-SHA1 of the username (see livestreamconfig.ICEServer.WithCredentials)
+func authHandler(secret string) turn.AuthHandler {
+	return func(username string, realm string, srcAddr net.Addr) ([]byte, bool) {
+		expiry, _, _ := strings.Cut(username, ":")
+		timestamp, err := strconv.ParseInt(expiry, 10, 64)
+		if err != nil || time.Now().Unix() >= timestamp {
+			log.Warn().Str("username", username).Str("remoteAddr", srcAddr.String()).Msg("Rejected TURN allocation with invalid or expired credentials")
+			return nil, false
+		}
+
+		mac := hmac.New(sha1.New, []byte(secret))
+		mac.Write([]byte(username))
+		password := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+		return turn.GenerateAuthKey(username, realm, password), true
+	}
+}
+
+// Denies relaying to loopback, link-local and private addresses unless they are allowed, otherwise anyone with credentials
+// could use the relay to reach the network of the server. The addresses of this server itself are always allowed, since
+// that is where the peer connections of the server live
+func permissionHandler(allowPrivate bool, serverIps []string) turn.PermissionHandler {
+	allowed := make([]net.IP, 0, len(serverIps))
+	for _, ip := range serverIps {
+		if parsed := net.ParseIP(ip); parsed != nil {
+			allowed = append(allowed, parsed)
+		}
+	}
+
+	return func(clientAddr net.Addr, peerIp net.IP) bool {
+		if allowPrivate {
+			return true
+		}
+		for _, ip := range allowed {
+			if ip.Equal(peerIp) {
+				return true
+			}
+		}
+		if peerIp.IsLoopback() || peerIp.IsPrivate() || peerIp.IsLinkLocalUnicast() || peerIp.IsLinkLocalMulticast() ||
+			peerIp.IsUnspecified() || peerIp.IsMulticast() {
+			log.Warn().Str("peerIp", peerIp.String()).Str("remoteAddr", clientAddr.String()).Msg("Denied TURN permission to a private address")
+			return false
+		}
+		return true
+	}
+}